@@ -1,6 +1,8 @@
 const express = require('express')
 const app = express()
 const bodyParser = require('body-parser')
+const readline = require('readline')
+const zlib = require('zlib')
 const port = 3000
 
 app.use(bodyParser.json({type: 'application/json', inflate: true}))
@@ -16,7 +18,175 @@ app.get('/foo', (req, res) => {
   res.send('foo path\n')
 })
 
+// Content encodings this server can decompress. Requests with other
+// encodings are rejected with the supported encodings listed in the
+// Accept-Encoding header (RFC 7694), so agents can fall back to one of them.
+const supportedEncodings = ['gzip', 'identity']
+
+app.post('/kubernetes/resource', (req, res, next) => {
+  const encoding = (req.get('Content-Encoding') || 'identity').toLowerCase()
+  if (!supportedEncodings.includes(encoding)) {
+    console.log(`rejecting unsupported content encoding: ${encoding}`)
+    res.set('Accept-Encoding', supportedEncodings.join(', '))
+    res.status(415).send('unsupported content encoding')
+    return
+  }
+  next()
+})
+
+// Deduplication of retried requests. Agents send a deterministic
+// Idempotency-Key with each batch (snapshot id, sequence number and content
+// hash), so a retry of a request that was already processed, e.g. after the
+// agent timed out waiting for the response, is acknowledged without being
+// processed again. A retry that arrives while the original request is still
+// being processed gets 409 and the agent retries it later.
+const idempotencyKeyTtlMs = 60 * 60 * 1000
+const idempotencyKeys = new Map()
+
+app.post('/kubernetes/resource', (req, res, next) => {
+  const key = req.get('Idempotency-Key')
+  if (!key) {
+    next()
+    return
+  }
+
+  const now = Date.now()
+  for (const [k, entry] of idempotencyKeys) {
+    if (entry.expires < now) {
+      idempotencyKeys.delete(k)
+    }
+  }
+
+  const entry = idempotencyKeys.get(key)
+  if (entry && entry.state === 'processing') {
+    res.status(409).send('request with the same idempotency key is being processed')
+    return
+  }
+  if (entry && entry.state === 'done') {
+    console.log(`already processed ${key}`)
+    res.set('Idempotent-Replayed', 'true')
+    res.send('post recieved')
+    return
+  }
+
+  idempotencyKeys.set(key, { state: 'processing', expires: now + idempotencyKeyTtlMs })
+  res.on('finish', () => {
+    if (res.statusCode >= 200 && res.statusCode < 300) {
+      idempotencyKeys.set(key, { state: 'done', expires: Date.now() + idempotencyKeyTtlMs })
+    } else {
+      // Not processed, allow the request to be retried
+      idempotencyKeys.delete(key)
+    }
+  })
+  next()
+})
+
+// Streamed snapshots (newline delimited json): the snapshot header, then a
+// line per cluster object item, with periodic checkpoints. Registered before
+// the json route so the stream is processed as it arrives rather than buffered.
+app.post('/kubernetes/resource', (req, res, next) => {
+  if (!req.is('application/x-ndjson')) {
+    next()
+    return
+  }
+
+  const body = req.get('Content-Encoding') === 'gzip' ? req.pipe(zlib.createGunzip()) : req
+  const lines = readline.createInterface({ input: body, crlfDelay: Infinity })
+  let header = null
+  let items = 0
+  let records = 0
+  let complete = false
+  let malformed = false
+  let lineNumber = 0
+
+  lines.on('line', (line) => {
+    lineNumber++
+    if (malformed) {
+      return
+    }
+    let record
+    try {
+      record = JSON.parse(line)
+    } catch (err) {
+      // Reject the stream, ignoring the rest of it
+      console.log(`malformed snapshot stream line ${lineNumber}: ${err.message}`)
+      malformed = true
+      res.status(400).send('malformed snapshot stream')
+      lines.close()
+      return
+    }
+    if (header === null) {
+      header = record
+      console.log()
+      console.log(`streaming snapshot ${header.snapshotId} from cluster ${describeCluster(header)}`)
+    } else if (record.checkpoint) {
+      console.log(`checkpoint ${record.checkpoint.sequence}: ${record.checkpoint.items} items, ${record.checkpoint.records || 0} records`)
+      complete = record.checkpoint.final === true && record.checkpoint.items === items &&
+        (record.checkpoint.records || 0) === records
+    } else if (record.record) {
+      records++
+    } else {
+      items++
+    }
+  })
+  lines.on('close', () => {
+    if (malformed) {
+      return
+    }
+    if (!complete) {
+      console.log(`incomplete snapshot stream, received ${items} items`)
+      res.status(400).send('incomplete snapshot stream')
+      return
+    }
+    res.send('stream recieved')
+  })
+  body.on('error', (err) => {
+    console.log(`error reading snapshot stream: ${err}`)
+  })
+})
+
+// Cluster names are chosen by users and may collide; the cluster id (the
+// uid of the cluster's kube-system namespace) identifies the cluster
+function describeCluster(snapshot) {
+  const info = snapshot.clusterInfo
+  if (!info) {
+    return snapshot.clusterName
+  }
+  return `${snapshot.clusterName} (id ${info.clusterId}, ${info.platform || 'unknown platform'}, ${info.serverVersion}, ${info.nodeCount} nodes)`
+}
+
 app.post('/kubernetes/resource', (req, res) => {
+  // This server only decodes json payloads. Agents configured to use the
+  // protobuf encoding fall back to json when it is rejected.
+  if (!req.is('application/json')) {
+    console.log(`rejecting unsupported content type: ${req.get('Content-Type')}`)
+    res.status(415).send('unsupported content type')
+    return
+  }
+
+  // Sent by agents once every batch of a snapshot has been acknowledged.
+  // Batches are sent concurrently, so they may arrive in any order.
+  if (req.body.commit) {
+    console.log()
+    console.log(`snapshot ${req.body.snapshotId} from cluster ${req.body.clusterName} committed: ${req.body.commit.batches} batches, replaced: ${(req.body.commit.replaced || []).join(', ') || 'none'}`)
+    console.log(`cluster: ${describeCluster(req.body)}`)
+    res.send('commit recieved')
+    return
+  }
+
+  // Records derived by the agent from the snapshot's objects, e.g. the
+  // relationships between them, sent in batches after the objects
+  if (req.body.records) {
+    const types = {}
+    for (const record of req.body.records) {
+      types[record.type] = (types[record.type] || 0) + 1
+    }
+    console.log()
+    console.log(`snapshot ${req.body.snapshotId} batch ${req.body.sequence} records: ${JSON.stringify(types)}`)
+    res.send('records recieved')
+    return
+  }
+
   console.log()
   console.log("processing 'kubernetes/resource' path - request body: ")
   console.log(JSON.stringify(req.body))
@@ -0,0 +1,479 @@
+package altc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthProvider
+//
+// Obtains the credential presented to the ingest server with each request.
+type AuthProvider interface {
+	// Name identifies the provider in logs
+	Name() string
+	// Credential obtains a new credential
+	Credential(ctx context.Context) (*Credential, error)
+}
+
+// Credential is a header presented to the ingest server
+type Credential struct {
+	Header string
+	Value  string
+	// Zero if the credential doesn't expire
+	Expiry time.Time
+}
+
+const (
+	// "client_credentials" (default), "api_key", "service_account_token" or "private_key_jwt"
+	_authProviderEnv = "AUTH_PROVIDER"
+
+	_clientCredentialsAuthProvider   = "client_credentials"
+	_apiKeyAuthProvider              = "api_key"
+	_serviceAccountTokenAuthProvider = "service_account_token"
+	_privateKeyJwtAuthProvider       = "private_key_jwt"
+
+	// Credential values, read from Secrets
+	_authApiKeyEnv = "AUTH_API_KEY"
+	// PEM private key, alternatively to AUTH_PRIVATE_KEY_FILE
+	_authPrivateKeyEnv = "AUTH_PRIVATE_KEY"
+	// Header carrying the api key, default "X-Api-Key"
+	_authApiKeyHeaderEnv = "AUTH_API_KEY_HEADER"
+	// Projected service account token, bound to the ingest server's audience
+	_authServiceAccountTokenFileEnv = "AUTH_SERVICE_ACCOUNT_TOKEN_FILE"
+	// PEM private key (RSA, EC or Ed25519) signing the client assertions, and its key id
+	_authPrivateKeyFileEnv = "AUTH_PRIVATE_KEY_FILE"
+	_authPrivateKeyIdEnv   = "AUTH_PRIVATE_KEY_ID"
+
+	_defaultApiKeyHeader              = "X-Api-Key"
+	_defaultServiceAccountTokenFile   = "/var/run/secrets/altconsole/serviceaccount/token"
+	_jwtBearerClientAssertionType     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	_clientAssertionLifetime          = 5 * time.Minute
+	_serviceAccountTokenCheckInterval = time.Minute
+	// Credentials are renewed this long before they expire
+	_credentialExpiryMargin = time.Minute
+	_credentialTimeout      = 30 * time.Second
+)
+
+// newAuthProvider
+//
+// Returns the auth provider selected by AUTH_PROVIDER. The providers read
+// credential values from 'secrets' each time they obtain a credential, so
+// rotated values are used once the current credential is renewed.
+func newAuthProvider(httpClient *http.Client, keys *keySet, secrets *Secrets) (AuthProvider, error) {
+	tokenEndpoint := &tokenEndpoint{httpClient: httpClient, keys: keys}
+
+	switch provider := os.Getenv(_authProviderEnv); provider {
+	case "", _clientCredentialsAuthProvider:
+		return &clientCredentialsProvider{tokenEndpoint: tokenEndpoint, secrets: secrets}, nil
+	case _apiKeyAuthProvider:
+		header := os.Getenv(_authApiKeyHeaderEnv)
+		if header == "" {
+			header = _defaultApiKeyHeader
+		}
+		return &apiKeyProvider{header: header, secrets: secrets}, nil
+	case _serviceAccountTokenAuthProvider:
+		tokenFile := os.Getenv(_authServiceAccountTokenFileEnv)
+		if tokenFile == "" {
+			tokenFile = _defaultServiceAccountTokenFile
+		}
+		return &serviceAccountTokenProvider{tokenFile: tokenFile}, nil
+	case _privateKeyJwtAuthProvider:
+		return &privateKeyJwtProvider{tokenEndpoint: tokenEndpoint, secrets: secrets}, nil
+	default:
+		return nil, fmt.Errorf("unsupported auth provider %q", provider)
+	}
+}
+
+// credentials
+//
+// Caches the credential obtained from the auth provider until it is about
+// to expire or the server rejects it. The credential is obtained without
+// holding the lock, by the first sender needing it; concurrent senders wait
+// for it rather than making requests of their own.
+type credentials struct {
+	provider AuthProvider
+
+	mu         sync.Mutex
+	credential *Credential
+	// nil unless a credential is being obtained
+	pending *pendingCredential
+}
+
+// pendingCredential is a credential being obtained, set once 'done' is closed
+type pendingCredential struct {
+	done       chan struct{}
+	credential *Credential
+	err        error
+}
+
+// get returns the current credential, obtaining a new one if there is none,
+// it is about to expire, or 'renew' is set
+func (cs *credentials) get(ctx context.Context, renew bool) (*Credential, error) {
+	cs.mu.Lock()
+	if pending := cs.pending; pending != nil {
+		cs.mu.Unlock()
+		select {
+		case <-pending.done:
+			return pending.credential, pending.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if credential := cs.credential; credential != nil && !renew &&
+		(credential.Expiry.IsZero() || time.Until(credential.Expiry) > _credentialExpiryMargin) {
+		cs.mu.Unlock()
+		return credential, nil
+	}
+	pending := &pendingCredential{done: make(chan struct{})}
+	cs.pending = pending
+	cs.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, _credentialTimeout)
+	defer cancel()
+	pending.credential, pending.err = cs.provider.Credential(ctx)
+	if pending.err != nil {
+		pending.err = fmt.Errorf("%s auth provider: %w", cs.provider.Name(), pending.err)
+	}
+
+	cs.mu.Lock()
+	cs.pending = nil
+	if pending.err == nil {
+		cs.credential = pending.credential
+	}
+	cs.mu.Unlock()
+	close(pending.done)
+	return pending.credential, pending.err
+}
+
+// invalidate discards the current credential, so a new one is obtained for the next request
+func (cs *credentials) invalidate() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.credential = nil
+}
+
+// apiKeyProvider presents an api key
+type apiKeyProvider struct {
+	header  string
+	secrets *Secrets
+}
+
+func (p *apiKeyProvider) Name() string {
+	return _apiKeyAuthProvider
+}
+
+func (p *apiKeyProvider) Credential(context.Context) (*Credential, error) {
+	apiKey := p.secrets.Get(_authApiKeyEnv)
+	if apiKey == "" {
+		return nil, fmt.Errorf("%s is not set", _authApiKeyEnv)
+	}
+	return &Credential{Header: p.header, Value: apiKey}, nil
+}
+
+// serviceAccountTokenProvider
+//
+// Presents the agent's projected service account token, which the ingest
+// server verifies with the cluster's service account issuer (workload
+// identity federation). The kubelet rotates the token file before the token
+// expires, so the file is read again when the token is about to expire, and
+// at least every minute.
+type serviceAccountTokenProvider struct {
+	tokenFile string
+}
+
+func (p *serviceAccountTokenProvider) Name() string {
+	return _serviceAccountTokenAuthProvider
+}
+
+func (p *serviceAccountTokenProvider) Credential(context.Context) (*Credential, error) {
+	tokenBytes, err := os.ReadFile(p.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+
+	expiry := time.Now().Add(_serviceAccountTokenCheckInterval + _credentialExpiryMargin)
+	claims := &jwt.RegisteredClaims{}
+	// The token is verified by the server, only its expiry is needed here
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err == nil && claims.ExpiresAt != nil &&
+		claims.ExpiresAt.Time.Before(expiry) {
+		expiry = claims.ExpiresAt.Time
+	}
+
+	return &Credential{Header: "Authorization", Value: "Bearer " + token, Expiry: expiry}, nil
+}
+
+// clientCredentialsProvider
+//
+// Obtains an access token from the auth server with the client credentials
+// grant, authenticating with the client id and secret.
+type clientCredentialsProvider struct {
+	tokenEndpoint *tokenEndpoint
+	secrets       *Secrets
+}
+
+type AuthPayload struct {
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	Audience     string `json:"audience"`
+	GrantType    string `json:"grant_type"`
+}
+
+func (p *clientCredentialsProvider) Name() string {
+	return _clientCredentialsAuthProvider
+}
+
+func (p *clientCredentialsProvider) Credential(ctx context.Context) (*Credential, error) {
+	payloadObj := AuthPayload{
+		ClientId:     p.secrets.Get(_authClientIdEnv),
+		ClientSecret: p.secrets.Get(_authSecretEnv),
+		Audience:     authAudience(),
+		GrantType:    "client_credentials",
+	}
+
+	payloadBytes, err := json.Marshal(payloadObj)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error marshalling payload: %s", err))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", os.Getenv(_authUrlEnv), strings.NewReader(string(payloadBytes)))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("error creating request: %s", err))
+	}
+	req.Header.Add("content-type", "application/json")
+
+	return p.tokenEndpoint.requestToken(req)
+}
+
+// privateKeyJwtProvider
+//
+// Obtains an access token from the auth server with the client credentials
+// grant, authenticating with a client assertion signed by the agent's
+// private key (private_key_jwt, RFC 7523) rather than a shared secret.
+type privateKeyJwtProvider struct {
+	tokenEndpoint *tokenEndpoint
+	secrets       *Secrets
+}
+
+func (p *privateKeyJwtProvider) Name() string {
+	return _privateKeyJwtAuthProvider
+}
+
+func (p *privateKeyJwtProvider) Credential(ctx context.Context) (*Credential, error) {
+	authUrl := os.Getenv(_authUrlEnv)
+	clientId := p.secrets.Get(_authClientIdEnv)
+
+	signer, err := p.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	assertion, err := clientAssertion(signer, p.secrets.Get(_authPrivateKeyIdEnv), clientId, authUrl)
+	if err != nil {
+		return nil, fmt.Errorf("error signing client assertion: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientId},
+		"client_assertion_type": {_jwtBearerClientAssertionType},
+		"client_assertion":      {assertion},
+	}
+	if audience := authAudience(); audience != "" {
+		form.Set("audience", audience)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", authUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("error creating request: %s", err))
+	}
+	req.Header.Add("content-type", "application/x-www-form-urlencoded")
+
+	return p.tokenEndpoint.requestToken(req)
+}
+
+// privateKey loads the private key from AUTH_PRIVATE_KEY or AUTH_PRIVATE_KEY_FILE
+func (p *privateKeyJwtProvider) privateKey() (crypto.Signer, error) {
+	if privateKey := p.secrets.Get(_authPrivateKeyEnv); privateKey != "" {
+		return parsePrivateKey([]byte(privateKey), _authPrivateKeyEnv)
+	}
+
+	file := os.Getenv(_authPrivateKeyFileEnv)
+	if file == "" {
+		return nil, fmt.Errorf("neither %s nor %s is set", _authPrivateKeyEnv, _authPrivateKeyFileEnv)
+	}
+	keyBytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(keyBytes, file)
+}
+
+// clientAssertion returns a short-lived JWT identifying the client to the token endpoint
+func clientAssertion(signer crypto.Signer, keyId string, clientId string, tokenUrl string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Issuer:    clientId,
+		Subject:   clientId,
+		Audience:  jwt.ClaimStrings{tokenUrl},
+		ID:        hex.EncodeToString(jti),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(_clientAssertionLifetime)),
+	}
+
+	token := jwt.NewWithClaims(signingMethod(signer), claims)
+	if keyId != "" {
+		token.Header["kid"] = keyId
+	}
+	return token.SignedString(signer)
+}
+
+// signingMethod returns the JWT signing method for the private key
+func signingMethod(signer crypto.Signer) jwt.SigningMethod {
+	switch key := signer.(type) {
+	case *ecdsa.PrivateKey:
+		switch key.Curve.Params().BitSize {
+		case 384:
+			return jwt.SigningMethodES384
+		case 521:
+			return jwt.SigningMethodES512
+		}
+		return jwt.SigningMethodES256
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// tokenEndpoint requests access tokens from the auth server and verifies them
+type tokenEndpoint struct {
+	httpClient *http.Client
+	keys       *keySet
+}
+
+// authResponseError is the error returned when the auth server doesn't grant a token
+type authResponseError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *authResponseError) Error() string {
+	return fmt.Sprintf("authorization request failed (%d): %s", e.StatusCode, e.Body)
+}
+
+func (te *tokenEndpoint) requestToken(req *http.Request) (*Credential, error) {
+	fmt.Println("Authorizing...")
+	res, err := te.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("authorization request error: %w", err)
+	}
+	defer res.Body.Close()
+
+	authResponseBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading authorization response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &authResponseError{StatusCode: res.StatusCode, Body: string(authResponseBody)}
+	}
+
+	type AuthResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		TokenType   string `json:"token_type"`
+	}
+
+	authResponse := AuthResponse{}
+	err = json.Unmarshal(authResponseBody, &authResponse)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("error unmarshalling authResponseString: %s", err))
+	}
+
+	authTokenId, err := te.verify(authResponse.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("authTokenId:", authTokenId)
+
+	credential := &Credential{Header: "Authorization", Value: "Bearer " + authResponse.AccessToken}
+	if authResponse.ExpiresIn > 0 {
+		credential.Expiry = time.Now().Add(time.Duration(authResponse.ExpiresIn) * time.Second)
+	}
+	return credential, nil
+}
+
+// verify validates the access token and returns its token id claim
+func (te *tokenEndpoint) verify(accessToken string) (string, error) {
+	type CustomClaims struct {
+		TokenId string `json:"https://altconsole.register.com/clientTokenId"`
+		jwt.RegisteredClaims
+	}
+	claims := &CustomClaims{}
+
+	_, err := jwt.ParseWithClaims(accessToken, claims, te.keys.Keyfunc)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("error processing jwt claims: %s", err))
+	}
+
+	// Validate issuer and audience
+	if claims.RegisteredClaims.Issuer != te.keys.issuer {
+		return "", errors.New(fmt.Sprintf("unexpected issuer: %s", claims.RegisteredClaims.Issuer))
+	}
+
+	if len(claims.RegisteredClaims.Audience) == 0 || claims.RegisteredClaims.Audience[0] != authAudience() {
+		return "", errors.New(fmt.Sprintf("unexpected audience: %v", claims.RegisteredClaims.Audience))
+	}
+
+	return claims.TokenId, nil
+}
+
+func authAudience() string {
+	authAudienceBytes, _ := base64.StdEncoding.DecodeString(os.Getenv(_authAudienceEnv))
+	return string(authAudienceBytes)
+}
+
+// parsePrivateKey parses a PEM encoded (PKCS #1, PKCS #8 or SEC 1) private key
+func parsePrivateKey(keyBytes []byte, file string) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", file)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key in %s: %w", file, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T in %s", key, file)
+	}
+	return signer, nil
+}
@@ -0,0 +1,181 @@
+package altc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testAuthProvider returns its credential once released, counting the credentials obtained
+type testAuthProvider struct {
+	release  chan struct{}
+	obtained atomic.Int32
+	err      error
+}
+
+func (p *testAuthProvider) Name() string {
+	return "test"
+}
+
+func (p *testAuthProvider) Credential(context.Context) (*Credential, error) {
+	<-p.release
+	p.obtained.Add(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &Credential{Header: "Authorization", Value: "token"}, nil
+}
+
+func TestCredentialsShared(t *testing.T) {
+	provider := &testAuthProvider{release: make(chan struct{})}
+	cs := &credentials{provider: provider}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cs.get(context.Background(), false); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	waitForPending(t, cs)
+
+	// A sender can give up while the credential is being obtained
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cs.get(ctx, false); !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want %v", err, context.Canceled)
+	}
+
+	close(provider.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if obtained := provider.obtained.Load(); obtained != 1 {
+		t.Errorf("obtained %d credentials, want 1", obtained)
+	}
+}
+
+func TestCredentialError(t *testing.T) {
+	provider := &testAuthProvider{release: make(chan struct{}), err: errors.New("unavailable")}
+	close(provider.release)
+	cs := &credentials{provider: provider}
+
+	if _, err := cs.get(context.Background(), false); err == nil {
+		t.Fatal("no error")
+	}
+	// The failure isn't cached
+	if _, err := cs.get(context.Background(), false); err == nil {
+		t.Fatal("no error")
+	}
+	if obtained := provider.obtained.Load(); obtained != 2 {
+		t.Errorf("obtained %d credentials, want 2", obtained)
+	}
+}
+
+func TestRequestTokenConnectionError(t *testing.T) {
+	// Nothing listens on the auth server's address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authUrl := "http://" + listener.Addr().String() + "/token"
+	listener.Close()
+
+	tokenEndpoint := &tokenEndpoint{httpClient: http.DefaultClient}
+	req, err := http.NewRequest(http.MethodPost, authUrl, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection error is kept, so it can be classified
+	var opError *net.OpError
+	if _, err := tokenEndpoint.requestToken(req); !errors.As(err, &opError) {
+		t.Fatalf("error = %v, want the connection error", err)
+	}
+}
+
+func TestSendCredentialError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want SendErrorKind
+	}{
+		{name: "connection error", err: fmt.Errorf("authorization request error: %w", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), want: RetryableSendError},
+		{name: "timeout", err: context.DeadlineExceeded, want: RetryableSendError},
+		{name: "auth server unavailable", err: &authResponseError{StatusCode: http.StatusServiceUnavailable}, want: RetryableSendError},
+		{name: "auth server throttling", err: &authResponseError{StatusCode: http.StatusTooManyRequests}, want: RetryableSendError},
+		{name: "invalid secret", err: &authResponseError{StatusCode: http.StatusUnauthorized}, want: UnauthorizedSendError},
+		{name: "invalid request", err: &authResponseError{StatusCode: http.StatusBadRequest}, want: UnauthorizedSendError},
+		{name: "configuration", err: fmt.Errorf("%s is not set", _authApiKeyEnv), want: PermanentSendError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("request made without a credential")
+			}))
+			defer server.Close()
+			client := newTestClient(t, server)
+			provider := &testAuthProvider{release: make(chan struct{}), err: test.err}
+			close(provider.release)
+			client.credentials = &credentials{provider: provider}
+
+			snapshotObject := &SnapshotObject{SnapshotId: "snapshot", Sequence: 1, Data: []*ClusterObjectItem{}}
+			_, _, err := client.send(context.Background(), snapshotObject, JSONEncoding, Compression{Codec: IdentityCodec})
+			if kind := SendErrorKindOf(err); kind != test.want {
+				t.Fatalf("error = %v, want a %s send error", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSendPermanentCredentialErrorNotRetried(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request made without a credential")
+	}))
+	defer server.Close()
+	client := newTestClient(t, server)
+	provider := &testAuthProvider{release: make(chan struct{}), err: &authResponseError{StatusCode: http.StatusUnauthorized}}
+	close(provider.release)
+	client.credentials = &credentials{provider: provider}
+
+	snapshotObject := &SnapshotObject{SnapshotId: "snapshot", Sequence: 1, Data: []*ClusterObjectItem{}}
+	if _, err := client.Send(context.Background(), snapshotObject); SendErrorKindOf(err) != UnauthorizedSendError {
+		t.Fatalf("error = %v, want an unauthorized send error", err)
+	}
+	if obtained := provider.obtained.Load(); obtained != 1 {
+		t.Errorf("obtained %d credentials, want 1", obtained)
+	}
+}
+
+// waitForPending waits until a credential is being obtained
+func waitForPending(t *testing.T, cs *credentials) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		cs.mu.Lock()
+		pending := cs.pending != nil
+		cs.mu.Unlock()
+		if pending {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a credential to be obtained")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
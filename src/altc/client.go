@@ -1,36 +1,49 @@
 package altc
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/MicahParks/keyfunc/v2"
 	"github.com/gogama/httpx"
 	"github.com/gogama/httpx/request"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/gogama/httpx/retry"
 	"io"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 type Client struct {
+	// Encoding requested for snapshot payloads
+	encoding Encoding
+	// Set once the server rejects protobuf payloads, after which json is used
+	protobufRejected atomic.Bool
+	// Compression of request bodies sent to the server
+	compression Compression
+	// Set once the server rejects the configured compression
+	fallbackCompression atomic.Pointer[Compression]
+	// Paces requests and upload bandwidth
+	limiter *rateLimiter
+	// Client for the requests to the auth and ingest servers (see newHTTPClient)
+	httpClient *http.Client
+	// Credential presented with each request, from the auth provider
+	credentials *credentials
 }
 
-type AuthPayload struct {
-	ClientId     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
-	Audience     string `json:"audience"`
-	GrantType    string `json:"grant_type"`
-}
+type Encoding string
+
+const (
+	JSONEncoding     Encoding = "json"
+	ProtobufEncoding Encoding = "protobuf"
+)
 
 const (
 	_sendTimeout         = 30 * time.Second
+	_maxSendAttempts     = 4
 	_authUrlEnv          = "AUTH_URL"
 	_authClientIdEnv     = "AUTH_CLIENT_ID"
 	_authSecretEnv       = "AUTH_SECRET"
@@ -38,63 +51,266 @@ const (
 	_authAudienceEnv     = "AUTH_AUDIENCE"
 	_authIssuerEnv       = "AUTH_ISSUER"
 	_serverUrlEnv        = "SERVER_URL"
+	_serverEncodingEnv   = "SERVER_ENCODING"
+	// '<codec>[:<level>]', see ParseCompression
+	_serverCompressionEnv = "SERVER_COMPRESSION"
+	// Client-side limits on the send pipeline, unlimited if not set
+	_serverRequestsPerSecondEnv = "SERVER_REQUESTS_PER_SECOND"
+	_serverBytesPerSecondEnv    = "SERVER_BYTES_PER_SECOND"
+
+	// Identifies a request so the server can discard retries of a request
+	// it has already processed. The server responds 409 (Conflict) while it
+	// is still processing a request with the same key.
+	_idempotencyKeyHeader = "Idempotency-Key"
+	// Set by the server when it has already processed a request with the
+	// same idempotency key
+	_idempotentReplayedHeader = "Idempotent-Replayed"
+
+	_jsonContentType     = "application/json"
+	_protobufContentType = "application/vnd.altconsole.snapshot.v1+protobuf"
 )
 
-func NewClient() *Client {
-	return &Client{}
+// NewClient
+//
+// Returns a client for the auth and ingest servers, configured from the
+// environment, reading credential values from 'secrets'. Returns an error if
+// the TLS, egress or auth configuration is invalid.
+func NewClient(secrets *Secrets) (*Client, error) {
+	encoding := JSONEncoding
+	if Encoding(os.Getenv(_serverEncodingEnv)) == ProtobufEncoding {
+		encoding = ProtobufEncoding
+	}
+
+	compression, err := ParseCompression(os.Getenv(_serverCompressionEnv))
+	if err != nil {
+		fmt.Println(fmt.Sprintf("WARN: %s, using %s compression", err, defaultCompression))
+		compression = defaultCompression
+	}
+
+	requestsPerSecond, _ := strconv.ParseFloat(os.Getenv(_serverRequestsPerSecondEnv), 64)
+	bytesPerSecond, _ := strconv.Atoi(os.Getenv(_serverBytesPerSecondEnv))
+
+	httpClient, err := newHTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("invalid http client configuration: %w", err)
+	}
+
+	authIssuer, _ := base64.StdEncoding.DecodeString(os.Getenv(_authIssuerEnv))
+	authProvider, err := newAuthProvider(httpClient, newKeySet(httpClient, string(authIssuer)), secrets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth configuration: %w", err)
+	}
+	fmt.Println("auth provider:", authProvider.Name())
+
+	c := &Client{
+		encoding:    encoding,
+		compression: compression,
+		limiter:     newRateLimiter(requestsPerSecond, bytesPerSecond),
+		httpClient:  httpClient,
+		credentials: &credentials{provider: authProvider},
+	}
+	// Switch to rotated credentials with the next request
+	secrets.OnChange(c.credentials.invalidate)
+	return c, nil
+}
+
+// requestCompression
+//
+// Returns the compression to use for request bodies: the configured
+// compression, unless the server has rejected it.
+func (c *Client) requestCompression() Compression {
+	if fallback := c.fallbackCompression.Load(); fallback != nil {
+		return *fallback
+	}
+	return c.compression
+}
+
+// negotiate
+//
+// Adjusts the request format after the server has rejected a request as
+// unsupported (415). An Accept-Encoding header in the response means the
+// compression was rejected (RFC 7694), otherwise the protobuf encoding is
+// assumed to be the cause. Returns whether the request format has changed.
+func (c *Client) negotiate(header http.Header, encoding Encoding, compression Compression) bool {
+	if acceptEncoding := header.Get("Accept-Encoding"); acceptEncoding != "" && !acceptsEncoding(acceptEncoding, compression.Codec) {
+		fallback := Compression{Codec: IdentityCodec}
+		if acceptsEncoding(acceptEncoding, GzipCodec) {
+			fallback = defaultCompression
+		}
+		if fallback.Codec == compression.Codec {
+			return false
+		}
+
+		fmt.Println(fmt.Sprintf("server does not support %s compression (accepts %q), using %s",
+			compression.Codec, acceptEncoding, fallback))
+		c.fallbackCompression.Store(&fallback)
+		return true
+	}
+
+	if encoding == ProtobufEncoding {
+		fmt.Println("server does not support protobuf payloads, using json")
+		c.protobufRejected.Store(true)
+		return true
+	}
+	return false
 }
 
+// SnapshotEncoding
+//
+// Returns the encoding to use for snapshot payloads: the configured encoding,
+// unless the server has rejected protobuf payloads.
+func (c *Client) SnapshotEncoding() Encoding {
+	if c.encoding == ProtobufEncoding && c.protobufRejected.Load() {
+		return JSONEncoding
+	}
+	return c.encoding
+}
+
+// Register obtains a new credential from the auth provider
 func (c *Client) Register(ctx context.Context) error {
 
-	authTokenId, err := c.getAuthToken()
-	if err != nil {
+	if _, err := c.credentials.get(ctx, true); err != nil {
 		fmt.Println(err)
 		return err
 	}
-
-	fmt.Println("authTokenId:", authTokenId)
 	return nil
 }
 
-func (c *Client) Send(ctx context.Context, snapshotObject *SnapshotObject) error {
-
-	ctx, cancel := context.WithTimeout(ctx, _sendTimeout)
-	defer cancel()
-	maxSteps := 4
+// SendStats describes the encoded size of a sent snapshot object
+type SendStats struct {
+	// Size of the encoded snapshot object before compression
+	Bytes int64
+	// Size of the request body
+	CompressedBytes int64
+	// Compression used for the request body
+	Compression Compression
+}
 
-	backoff := wait.Backoff{
-		Duration: 500 * time.Millisecond,
-		Factor:   2,
-		Jitter:   0.0,
-		Steps:    maxSteps,
+// CompressionRatio returns the ratio of the uncompressed to the compressed size
+func (s *SendStats) CompressionRatio() float64 {
+	if s.CompressedBytes == 0 {
+		return 0
 	}
+	return float64(s.Bytes) / float64(s.CompressedBytes)
+}
 
-	attempts := 0
-	err := wait.ExponentialBackoffWithContext(ctx, backoff, func() (done bool, err error) {
-		attempts++
-
-		execution, err := send(snapshotObject)
+// Send
+//
+// Sends the snapshot object to the server, retrying transient failures (429,
+// 5xx, connection errors) with jittered exponential backoff, or after the
+// delay requested by the server's Retry-After header. A 401 response is
+// retried once after re-authenticating. Requests are paced by the configured
+// request and bandwidth limits, and slowed down while the server throttles
+// them (429); each attempt is limited to _sendTimeout once it is allowed to
+// proceed. Returns a *SendError classifying the failure if the snapshot
+// object could not be sent.
+func (c *Client) Send(ctx context.Context, snapshotObject *SnapshotObject) (*SendStats, error) {
+	backoff := newSendBackoff()
+	reauthenticated := false
+	for attempt := 1; ; attempt++ {
+		encoding := c.SnapshotEncoding()
+		compression := c.requestCompression()
+		execution, stats, err := c.send(ctx, snapshotObject, encoding, compression)
+
+		var sendError *SendError
 		if err != nil {
-			fmt.Println(fmt.Sprintf("error sending resources on attempt %d: %s", attempts, err.Error()))
-			// Don't return the error from the conditionFunc, doing so will abort the retry.
-			// The point of the retry is to not consider an error an actual error if the condition
-			// succeeds before the max retry.
-			// 'done' is false since the condition has not succeeded yet
-			return false, nil
+			fmt.Println(fmt.Sprintf("error sending resources on attempt %d: %s", attempt, err.Error()))
+			sendError = transportError(err)
+		} else {
+			response := execution.Response
+			if response.Header.Get(_idempotentReplayedHeader) == "true" {
+				fmt.Println(fmt.Sprintf("batch %s had already been processed by the server", snapshotObject.BatchId))
+			}
+
+			if sendError = responseError(response, execution.Body); sendError == nil {
+				c.limiter.succeeded()
+				return stats, nil
+			}
+			if response.StatusCode == http.StatusTooManyRequests {
+				c.limiter.throttled()
+			}
+			fmt.Println(fmt.Sprintf("response from altc-nodeserver on attempt %d (%d): %s", attempt, response.StatusCode, execution.Body))
+
+			// The server doesn't support the encoding or compression, retry with a supported format
+			if response.StatusCode == http.StatusUnsupportedMediaType && c.negotiate(response.Header, encoding, compression) {
+				continue
+			}
+
+			if sendError.Kind == UnauthorizedSendError && !reauthenticated {
+				reauthenticated = true
+				if err := c.reauthenticate(ctx); err == nil {
+					continue
+				}
+			}
+		}
+
+		if sendError.Kind != RetryableSendError || attempt >= _maxSendAttempts {
+			return nil, sendError
+		}
+
+		delay := backoff.Step()
+		if sendError.RetryAfter > 0 {
+			delay = sendError.RetryAfter
 		}
-		if execution.Response.StatusCode != 200 {
-			fmt.Println(fmt.Sprintf("response from altc-nodeserver (%d): %s", execution.Response.StatusCode, execution.Response.Body))
+		// Leave it to the caller to wait for a Retry-After beyond the send timeout
+		if delay > _sendTimeout {
+			return nil, sendError
 		}
 
-		return true, nil
-	})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, sendError
+		}
+	}
+}
+
+// newSendBackoff returns the backoff between the attempts at sending a request
+func newSendBackoff() wait.Backoff {
+	return wait.Backoff{
+		Duration: 500 * time.Millisecond,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    _maxSendAttempts,
+	}
+}
+
+// reauthenticate obtains new credentials after the server has rejected the current ones
+func (c *Client) reauthenticate(ctx context.Context) error {
+	fmt.Println("credentials rejected by the server, re-authenticating")
+	return c.Register(ctx)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
 
-	return err
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += int64(n)
+	return n, err
 }
 
-func send(snapshotObject *SnapshotObject) (*request.Execution, error) {
+// send
+//
+// Makes an attempt at sending the snapshot object. The request is paced by
+// the rate limiter, without a deadline, before the attempt's _sendTimeout
+// starts, so waiting for the limiter doesn't fail the attempt.
+func (c *Client) send(ctx context.Context, snapshotObject *SnapshotObject, encoding Encoding, compression Compression) (*request.Execution, *SendStats, error) {
+	if err := c.limiter.waitRequest(ctx); err != nil {
+		return nil, nil, limiterError(err)
+	}
+
+	credential, err := c.credentials.get(ctx, false)
+	if err != nil {
+		return nil, nil, credentialError(err)
+	}
+
 	fmt.Println(fmt.Sprintf("sending %d snapshotObject items", len((*snapshotObject).Data)))
-	client := &httpx.Client{}
+	// Retries are handled by Send
+	client := &httpx.Client{HTTPDoer: c.httpClient, RetryPolicy: retry.Never}
 	pr, pw := io.Pipe()
 
 	defer pr.Close()
@@ -107,16 +323,26 @@ func send(snapshotObject *SnapshotObject) (*request.Execution, error) {
 	   to the read channel, which happens during the read operation after the bytes
 	   are received from write channel.
 	*/
+	encodedBytes := make(chan int64, 1)
 	go func() {
-		gw := gzip.NewWriter(pw)
+		zw, err := compression.newWriter(pw)
+		if err != nil {
+			encodedBytes <- 0
+			pw.CloseWithError(err)
+			return
+		}
+		cw := &countingWriter{w: zw}
 
-		if err := json.NewEncoder(gw).Encode(snapshotObject); err != nil {
-			fmt.Println("error encoding gzip data:", err)
+		if err := encode(cw, snapshotObject, encoding); err != nil {
+			fmt.Println(fmt.Sprintf("error encoding %s data: %s", compression.Codec, err))
+			// Fail the request rather than sending a partial body
+			pw.CloseWithError(err)
 		}
 
-		if err := gw.Close(); err != nil {
-			fmt.Println("error closing gzip writer:", err)
+		if err := zw.Close(); err != nil {
+			fmt.Println(fmt.Sprintf("error closing %s writer: %s", compression.Codec, err))
 		}
+		encodedBytes <- cw.count
 		defer func() {
 			if err := pw.Close(); err != nil {
 				fmt.Println("error closing pipe writer:", err)
@@ -125,98 +351,58 @@ func send(snapshotObject *SnapshotObject) (*request.Execution, error) {
 	}()
 
 	url := os.Getenv(_serverUrlEnv)
-	plan, err := request.NewPlan("POST", url, pr)
-	if err != nil {
-		return nil, err
-	}
-	plan.Header.Set("Content-Type", "application/json")
-	plan.Header.Set("Content-Encoding", "gzip")
-
-	return client.Do(plan)
-}
-
-func (c *Client) getAuthToken() (string, error) {
-
-	authUrl := os.Getenv(_authUrlEnv)
-	authClientId := os.Getenv(_authClientIdEnv)
-	authSecret := os.Getenv(_authSecretEnv)
-	authPublicKeySetBytes, _ := base64.StdEncoding.DecodeString(os.Getenv(_authPublicKeySetEnv))
-	authIssuerBytes, _ := base64.StdEncoding.DecodeString(os.Getenv(_authIssuerEnv))
-	authIssuer := string(authIssuerBytes)
-	authAudienceBytes, _ := base64.StdEncoding.DecodeString(os.Getenv(_authAudienceEnv))
-	authAudience := string(authAudienceBytes)
-
-	payloadObj := AuthPayload{
-		ClientId:     authClientId,
-		ClientSecret: authSecret,
-		Audience:     authAudience,
-		GrantType:    "client_credentials",
-	}
-
-	payloadBytes, err := json.Marshal(payloadObj)
+	// The plan reads the whole body, so the encoding is complete once it is created
+	plan, err := request.NewPlanWithContext(ctx, "POST", url, pr)
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("Error marshalling payload: %s", err))
+		return nil, nil, err
 	}
-
-	fmt.Println("Authorizing...")
-	payload := strings.NewReader(string(payloadBytes))
-	req, err := http.NewRequest("POST", authUrl, payload)
-	if err != nil {
-		return "", errors.New(fmt.Sprintf("error creating request: %s", err))
+	plan.Header.Set("Content-Type", contentType(encoding))
+	plan.Header.Set(credential.Header, credential.Value)
+	setContentEncoding(plan.Header, compression)
+	if snapshotObject.BatchId != "" {
+		plan.Header.Set(_idempotencyKeyHeader, snapshotObject.BatchId)
 	}
 
-	req.Header.Add("content-type", "application/json")
-	res, err := http.DefaultClient.Do(req)
-	defer res.Body.Close()
-
-	if err != nil {
-		return "", errors.New(fmt.Sprintf("authorization request error: %s", err))
-	}
-
-	authResponseBody, err := io.ReadAll(res.Body)
-	type AuthResponse struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int    `json:"expires_in"`
-		TokenType   string `json:"token_type"`
+	stats := &SendStats{
+		Bytes:           <-encodedBytes,
+		CompressedBytes: int64(len(plan.Body)),
+		Compression:     compression,
 	}
+	fmt.Println(fmt.Sprintf("encoded snapshotObject: %d bytes, %d bytes compressed (%s, ratio %.2f)",
+		stats.Bytes, stats.CompressedBytes, compression, stats.CompressionRatio()))
 
-	authResponse := AuthResponse{}
-	err = json.Unmarshal(authResponseBody, &authResponse)
-	if err != nil {
-		return "", errors.New(fmt.Sprintf("error unmarshalling authResponseString: %s", err))
+	if err := c.limiter.waitBytes(ctx, len(plan.Body)); err != nil {
+		return nil, stats, limiterError(err)
 	}
 
-	rawAuthPublicKeySet := json.RawMessage(authPublicKeySetBytes)
-	jwks, err := keyfunc.NewJSON(rawAuthPublicKeySet)
-	if err != nil {
-		return "", errors.New(fmt.Sprintf("error creating jwks: %s", err))
-	}
+	attemptCtx, cancel := context.WithTimeout(ctx, _sendTimeout)
+	defer cancel()
+	execution, err := client.Do(plan.WithContext(attemptCtx))
+	return execution, stats, err
+}
 
-	type CustomClaims struct {
-		TokenId string `json:"https://altconsole.register.com/clientTokenId"`
-		jwt.RegisteredClaims
+func encode(w io.Writer, snapshotObject *SnapshotObject, encoding Encoding) error {
+	if encoding == ProtobufEncoding {
+		protobufBytes, err := encodeProtobuf(snapshotObject)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(protobufBytes)
+		return err
 	}
-	claims := &CustomClaims{}
 
-	_, err = jwt.ParseWithClaims(authResponse.AccessToken, claims, jwks.Keyfunc)
-	if err != nil {
-		return "", errors.New(fmt.Sprintf("error processing jwt claims: %s", err))
-	}
+	return json.NewEncoder(w).Encode(snapshotObject)
+}
 
-	// Validate issuer and audience
-	if claims.RegisteredClaims.Issuer != authIssuer {
-		return "", errors.New(fmt.Sprintf("unexpected issuer: %s", claims.RegisteredClaims.Issuer))
+func setContentEncoding(header http.Header, compression Compression) {
+	if compression.Codec != IdentityCodec {
+		header.Set("Content-Encoding", compression.Codec)
 	}
+}
 
-	if claims.RegisteredClaims.Audience[0] != authAudience {
-		return "", errors.New(fmt.Sprintf("unexpected issuer: %s", claims.RegisteredClaims.Audience[0]))
+func contentType(encoding Encoding) string {
+	if encoding == ProtobufEncoding {
+		return _protobufContentType
 	}
-
-	/*
-		fmt.Println("issuer  :", claims.RegisteredClaims.Issuer)
-		fmt.Println("audience:", claims.RegisteredClaims.Audience[0])
-		fmt.Println("expires :", claims.RegisteredClaims.ExpiresAt)
-	*/
-
-	return claims.TokenId, nil
+	return _jsonContentType
 }
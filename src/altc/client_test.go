@@ -0,0 +1,67 @@
+package altc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendWaitsForLimiter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	client := newTestClient(t, server)
+	client.limiter = newRateLimiter(5, 0)
+
+	snapshotObject := &SnapshotObject{SnapshotId: "snapshot", Sequence: 1, Data: []*ClusterObjectItem{}}
+	for i := 0; i < 2; i++ {
+		if _, err := client.Send(context.Background(), snapshotObject); err != nil {
+			t.Fatalf("send %d: %s", i, err)
+		}
+	}
+}
+
+func TestLimiterErrorRetryable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request made without waiting for the limiter")
+	}))
+	defer server.Close()
+	client := newTestClient(t, server)
+	client.limiter = newRateLimiter(0.01, 0)
+	client.limiter.requests.Allow()
+
+	// The wait doesn't fit in the context's deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	snapshotObject := &SnapshotObject{SnapshotId: "snapshot", Sequence: 1, Data: []*ClusterObjectItem{}}
+	_, _, err := client.send(ctx, snapshotObject, JSONEncoding, Compression{Codec: IdentityCodec})
+
+	var sendError *SendError
+	if !errors.As(err, &sendError) || sendError.Kind != RetryableSendError {
+		t.Fatalf("error = %v, want a retryable send error", err)
+	}
+}
+
+func TestNewClientInvalidConfiguration(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "auth provider", env: map[string]string{_authProviderEnv: "unknown"}},
+		{name: "proxy", env: map[string]string{_proxyUrlEnv: "://proxy"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			if client, err := NewClient(NewSecrets()); err == nil {
+				t.Errorf("client = %v, want an error", client)
+			}
+		})
+	}
+}
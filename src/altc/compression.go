@@ -0,0 +1,122 @@
+package altc
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Compression
+//
+// The codec used to compress request bodies, and its level. The codec name
+// is the value of the Content-Encoding header.
+type Compression struct {
+	Codec string
+	// Codec specific level; zero for the codec's default
+	Level int
+}
+
+const (
+	GzipCodec = "gzip"
+	ZstdCodec = "zstd"
+	// No compression
+	IdentityCodec = "identity"
+)
+
+var defaultCompression = Compression{Codec: GzipCodec}
+
+// ParseCompression
+//
+// Parses a compression setting of the form '<codec>[:<level>]', where codec is
+// gzip, zstd or none, e.g. "gzip:9". gzip levels are 1 (fastest) to 9 (best
+// compression), zstd levels are 1 (fastest) to 4 (best compression).
+func ParseCompression(value string) (Compression, error) {
+	if value == "" {
+		return defaultCompression, nil
+	}
+
+	codec, levelValue, hasLevel := strings.Cut(strings.ToLower(value), ":")
+	compression := Compression{Codec: codec}
+	if codec == "none" {
+		compression.Codec = IdentityCodec
+	}
+
+	if hasLevel {
+		level, err := strconv.Atoi(levelValue)
+		if err != nil {
+			return Compression{}, fmt.Errorf("invalid compression level %q", levelValue)
+		}
+		compression.Level = level
+	}
+
+	switch compression.Codec {
+	case GzipCodec:
+		if hasLevel && (compression.Level < gzip.BestSpeed || compression.Level > gzip.BestCompression) {
+			return Compression{}, fmt.Errorf("invalid gzip level %d", compression.Level)
+		}
+	case ZstdCodec:
+		if hasLevel && (compression.Level < int(zstd.SpeedFastest) || compression.Level > int(zstd.SpeedBestCompression)) {
+			return Compression{}, fmt.Errorf("invalid zstd level %d", compression.Level)
+		}
+	case IdentityCodec:
+	default:
+		return Compression{}, fmt.Errorf("unsupported compression codec %q", codec)
+	}
+
+	return compression, nil
+}
+
+func (c Compression) String() string {
+	if c.Level == 0 {
+		return c.Codec
+	}
+	return fmt.Sprintf("%s:%d", c.Codec, c.Level)
+}
+
+// compressWriter is a compressing writer that can be flushed mid-stream
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (c Compression) newWriter(w io.Writer) (compressWriter, error) {
+	switch c.Codec {
+	case GzipCodec:
+		if c.Level == 0 {
+			return gzip.NewWriter(w), nil
+		}
+		return gzip.NewWriterLevel(w, c.Level)
+	case ZstdCodec:
+		options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if c.Level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevel(c.Level)))
+		}
+		return zstd.NewWriter(w, options...)
+	default:
+		return nopCompressWriter{w}, nil
+	}
+}
+
+type nopCompressWriter struct {
+	io.Writer
+}
+
+func (nopCompressWriter) Close() error { return nil }
+func (nopCompressWriter) Flush() error { return nil }
+
+// acceptsEncoding
+//
+// Returns whether the Accept-Encoding header value lists the codec.
+// The identity encoding is acceptable unless explicitly excluded.
+func acceptsEncoding(acceptEncoding string, codec string) bool {
+	for _, value := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(value), ";")
+		if strings.EqualFold(strings.TrimSpace(name), codec) {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return codec == IdentityCodec
+}
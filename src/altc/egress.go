@@ -0,0 +1,141 @@
+package altc
+
+import (
+	"fmt"
+	"golang.org/x/net/http/httpproxy"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Proxy for the requests to the auth and ingest servers, e.g.
+	// "http://proxy.corp:3128"; requests to https servers are tunneled with
+	// CONNECT. Overrides the standard HTTPS_PROXY/HTTP_PROXY variables.
+	_proxyUrlEnv = "PROXY_URL"
+	// Basic auth credentials for the proxy, typically from a Secret; take
+	// precedence over credentials in the proxy url
+	_proxyUsernameEnv = "PROXY_USERNAME"
+	_proxyPasswordEnv = "PROXY_PASSWORD"
+	// Comma separated hosts, domains, IP addresses and CIDR ranges reached
+	// without the proxy
+	_noProxyEnv = "NO_PROXY"
+
+	_httpDialTimeoutEnv         = "HTTP_DIAL_TIMEOUT_SECONDS"
+	_httpKeepAliveEnv           = "HTTP_KEEPALIVE_SECONDS"
+	_httpTLSHandshakeTimeoutEnv = "HTTP_TLS_HANDSHAKE_TIMEOUT_SECONDS"
+	_httpMaxIdleConnsEnv        = "HTTP_MAX_IDLE_CONNS"
+	_httpMaxIdleConnsPerHostEnv = "HTTP_MAX_IDLE_CONNS_PER_HOST"
+	_httpIdleConnTimeoutEnv     = "HTTP_IDLE_CONN_TIMEOUT_SECONDS"
+
+	_defaultDialTimeout         = 30 * time.Second
+	_defaultKeepAlive           = 30 * time.Second
+	_defaultTLSHandshakeTimeout = 10 * time.Second
+	_defaultMaxIdleConns        = 100
+	// Batches are sent concurrently to the same server
+	_defaultMaxIdleConnsPerHost = 10
+	_defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// configureEgress
+//
+// Applies the proxy, connection pooling and timeout settings from the
+// environment to the transport, and logs them.
+func configureEgress(transport *http.Transport) error {
+	proxyConfig, err := newProxyConfig()
+	if err != nil {
+		return err
+	}
+	proxyFunc := proxyConfig.ProxyFunc()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   envSeconds(_httpDialTimeoutEnv, _defaultDialTimeout),
+		KeepAlive: envSeconds(_httpKeepAliveEnv, _defaultKeepAlive),
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = envSeconds(_httpTLSHandshakeTimeoutEnv, _defaultTLSHandshakeTimeout)
+	transport.MaxIdleConns = envCount(_httpMaxIdleConnsEnv, _defaultMaxIdleConns)
+	transport.MaxIdleConnsPerHost = envCount(_httpMaxIdleConnsPerHostEnv, _defaultMaxIdleConnsPerHost)
+	transport.IdleConnTimeout = envSeconds(_httpIdleConnTimeoutEnv, _defaultIdleConnTimeout)
+
+	fmt.Println(fmt.Sprintf("egress: https proxy %s, http proxy %s, no proxy %q, dial timeout %s, keepalive %s, TLS handshake timeout %s, "+
+		"max idle connections %d (%d per host), idle connection timeout %s",
+		redactedProxy(proxyConfig.HTTPSProxy), redactedProxy(proxyConfig.HTTPProxy), proxyConfig.NoProxy, dialer.Timeout, dialer.KeepAlive, transport.TLSHandshakeTimeout,
+		transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout))
+	return nil
+}
+
+// newProxyConfig
+//
+// Returns the proxy configuration from the standard HTTPS_PROXY, HTTP_PROXY
+// and NO_PROXY variables, each proxy used for the requests with its scheme,
+// unless PROXY_URL overrides the proxy for both. The PROXY_USERNAME and
+// PROXY_PASSWORD credentials, if set, are used with the proxies.
+func newProxyConfig() (*httpproxy.Config, error) {
+	proxyConfig := httpproxy.FromEnvironment()
+	if proxy := os.Getenv(_proxyUrlEnv); proxy != "" {
+		proxyConfig.HTTPProxy = proxy
+		proxyConfig.HTTPSProxy = proxy
+	}
+
+	var err error
+	if proxyConfig.HTTPProxy, err = proxyWithCredentials(proxyConfig.HTTPProxy); err != nil {
+		return nil, err
+	}
+	if proxyConfig.HTTPSProxy, err = proxyWithCredentials(proxyConfig.HTTPSProxy); err != nil {
+		return nil, err
+	}
+	return proxyConfig, nil
+}
+
+// proxyWithCredentials
+//
+// Validates the proxy url, adding the PROXY_USERNAME and PROXY_PASSWORD
+// credentials if set. A proxy without a scheme (e.g. "proxy.corp:3128") is
+// an http proxy, as for httpproxy.
+func proxyWithCredentials(proxy string) (string, error) {
+	if proxy == "" {
+		return "", nil
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil || proxyUrl.Host == "" {
+		return "", fmt.Errorf("invalid proxy url %q", proxy)
+	}
+	if username := os.Getenv(_proxyUsernameEnv); username != "" {
+		proxyUrl.User = url.UserPassword(username, os.Getenv(_proxyPasswordEnv))
+	}
+	return proxyUrl.String(), nil
+}
+
+// redactedProxy returns the proxy url without its password for logging, "none" if there is no proxy
+func redactedProxy(proxy string) string {
+	if proxy == "" {
+		return "none"
+	}
+	proxyUrl, _ := url.Parse(proxy)
+	return proxyUrl.Redacted()
+}
+
+func envSeconds(name string, defaultValue time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv(name)); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultValue
+}
+
+func envCount(name string, defaultValue int) int {
+	if count, err := strconv.Atoi(os.Getenv(name)); err == nil && count > 0 {
+		return count
+	}
+	return defaultValue
+}
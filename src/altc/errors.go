@@ -0,0 +1,151 @@
+package altc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gogama/httpx/transient"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SendErrorKind classifies a failure to send a snapshot object, so the
+// caller can decide what to do with the batch
+type SendErrorKind string
+
+const (
+	// The request failed with a transient error (429, 5xx, connection
+	// reset, timeout) and the retries were exhausted. The batch can be resent.
+	RetryableSendError SendErrorKind = "Retryable"
+	// The server rejected the batch as too large (413). The batch should be
+	// split into smaller batches.
+	PayloadTooLargeSendError SendErrorKind = "PayloadTooLarge"
+	// The server rejected the credentials, even after re-authenticating, or the
+	// auth server refused to grant one (4xx)
+	UnauthorizedSendError SendErrorKind = "Unauthorized"
+	// The server rejected the batch (e.g. 400) or the request can't be made.
+	// Resending the batch won't succeed, so it should be dropped.
+	PermanentSendError SendErrorKind = "Permanent"
+)
+
+// SendError is the error returned when a snapshot object could not be sent
+type SendError struct {
+	Kind SendErrorKind
+	// Status code of the last response, zero if no response was received
+	StatusCode int
+	// Body of the last response
+	Body string
+	// Transport error of the last attempt
+	Err error
+	// Delay requested by the server's Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func (e *SendError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s send error: %s", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s send error: response from altc-nodeserver (%d): %s", e.Kind, e.StatusCode, e.Body)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// SendErrorKindOf returns the kind of the send error, or "" if 'err' is not a SendError
+func SendErrorKindOf(err error) SendErrorKind {
+	var sendError *SendError
+	if errors.As(err, &sendError) {
+		return sendError.Kind
+	}
+	return ""
+}
+
+// transportError classifies an error making a request, keeping the
+// classification of an error already classified (e.g. a credential error)
+func transportError(err error) *SendError {
+	var sendError *SendError
+	if errors.As(err, &sendError) {
+		return sendError
+	}
+	kind := PermanentSendError
+	if transient.Categorize(err) != transient.Not {
+		kind = RetryableSendError
+	}
+	return &SendError{Kind: kind, Err: err}
+}
+
+// limiterError classifies an error waiting for the rate limiter: the request
+// was not made, so it can be retried
+func limiterError(err error) *SendError {
+	return &SendError{Kind: RetryableSendError, Err: fmt.Errorf("rate limiter: %w", err)}
+}
+
+// credentialError
+//
+// Classifies an error obtaining a credential. The request can be retried if
+// the auth server couldn't be reached or is unavailable (429, 5xx). The auth
+// server rejecting the request (4xx) is unauthorized, and any other error is
+// the auth configuration's (e.g. a missing api key), so it is permanent.
+func credentialError(err error) *SendError {
+	var responseError *authResponseError
+	switch {
+	case errors.As(err, &responseError):
+		if responseError.StatusCode == http.StatusTooManyRequests || responseError.StatusCode >= 500 {
+			return &SendError{Kind: RetryableSendError, Err: err}
+		}
+		return &SendError{Kind: UnauthorizedSendError, Err: err}
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled),
+		transient.Categorize(err) != transient.Not:
+		return &SendError{Kind: RetryableSendError, Err: err}
+	}
+	return &SendError{Kind: PermanentSendError, Err: err}
+}
+
+// responseError
+//
+// Classifies a response, returning nil if the request succeeded.
+func responseError(response *http.Response, body []byte) *SendError {
+	statusCode := response.StatusCode
+	if statusCode >= 200 && statusCode < 300 {
+		return nil
+	}
+
+	sendError := &SendError{
+		StatusCode: statusCode,
+		Body:       string(body),
+		RetryAfter: retryAfter(response.Header.Get("Retry-After")),
+	}
+	switch {
+	case statusCode == http.StatusTooManyRequests,
+		statusCode == http.StatusRequestTimeout,
+		// The server is still processing an earlier attempt with the same idempotency key
+		statusCode == http.StatusConflict,
+		statusCode >= 500:
+		sendError.Kind = RetryableSendError
+	case statusCode == http.StatusRequestEntityTooLarge:
+		sendError.Kind = PayloadTooLargeSendError
+	case statusCode == http.StatusUnauthorized:
+		sendError.Kind = UnauthorizedSendError
+	default:
+		sendError.Kind = PermanentSendError
+	}
+	return sendError
+}
+
+// retryAfter parses a Retry-After header value: a number of seconds or an HTTP date
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -0,0 +1,155 @@
+package altc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// URL of the auth server's JWKS; discovered from the issuer if not set
+	_authJwksUrlEnv = "AUTH_JWKS_URL"
+
+	_jwksRefreshInterval = time.Hour
+	// Minimum time between refreshes triggered by tokens signed with unknown keys
+	_jwksRefreshRateLimit = 5 * time.Minute
+	// Timeout of the requests for the discovery document and the JWKS, which
+	// are fetched while the key set is locked, holding up token validation
+	_jwksFetchTimeout = 10 * time.Second
+	// Minimum time between attempts to fetch the JWKS while it is unavailable
+	_jwksRetryInterval = time.Minute
+)
+
+// keySet
+//
+// Keys verifying the access tokens issued by the auth server: the JWKS
+// fetched from the auth server, refreshed hourly and whenever a token is
+// signed with an unknown key, with the static AUTH_PUBLIC_KEY_SET as a
+// fallback while the JWKS can't be fetched or doesn't have the token's key.
+type keySet struct {
+	httpClient *http.Client
+	issuer     string
+
+	mu sync.Mutex
+	// nil until fetched
+	remote      *keyfunc.JWKS
+	lastAttempt time.Time
+	// nil if AUTH_PUBLIC_KEY_SET is not set
+	static *keyfunc.JWKS
+}
+
+func newKeySet(httpClient *http.Client, issuer string) *keySet {
+	ks := &keySet{httpClient: httpClient, issuer: issuer}
+
+	if authPublicKeySet := os.Getenv(_authPublicKeySetEnv); authPublicKeySet != "" {
+		authPublicKeySetBytes, _ := base64.StdEncoding.DecodeString(authPublicKeySet)
+		static, err := keyfunc.NewJSON(json.RawMessage(authPublicKeySetBytes))
+		if err != nil {
+			fmt.Println(fmt.Sprintf("WARN: invalid %s: %s", _authPublicKeySetEnv, err))
+		} else {
+			ks.static = static
+		}
+	}
+	return ks
+}
+
+// Keyfunc returns the key verifying the token (see jwt.Keyfunc)
+func (ks *keySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	remote := ks.remoteJWKS()
+	if remote != nil {
+		key, err := remote.Keyfunc(token)
+		if err == nil || ks.static == nil {
+			return key, err
+		}
+		fmt.Println(fmt.Sprintf("WARN: %s, using %s", err, _authPublicKeySetEnv))
+	}
+
+	if ks.static == nil {
+		return nil, errors.New("no JWKS available to verify the token")
+	}
+	return ks.static.Keyfunc(token)
+}
+
+// remoteJWKS returns the JWKS fetched from the auth server, fetching it if
+// it hasn't been fetched yet; nil if it can't be fetched
+func (ks *keySet) remoteJWKS() *keyfunc.JWKS {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.remote != nil || time.Since(ks.lastAttempt) < _jwksRetryInterval {
+		return ks.remote
+	}
+	ks.lastAttempt = time.Now()
+
+	jwksUrl, err := ks.jwksUrl()
+	if err != nil {
+		fmt.Println("WARN: unable to discover the JWKS url:", err)
+		return nil
+	}
+
+	remote, err := keyfunc.Get(jwksUrl, keyfunc.Options{
+		Client:            ks.httpClient,
+		RefreshInterval:   _jwksRefreshInterval,
+		RefreshRateLimit:  _jwksRefreshRateLimit,
+		RefreshTimeout:    _jwksFetchTimeout,
+		RefreshUnknownKID: true,
+		RefreshErrorHandler: func(err error) {
+			fmt.Println("WARN: error refreshing the JWKS:", err)
+		},
+	})
+	if err != nil {
+		fmt.Println(fmt.Sprintf("WARN: unable to fetch the JWKS from %s: %s", jwksUrl, err))
+		return nil
+	}
+
+	fmt.Println(fmt.Sprintf("fetched the JWKS from %s: %d keys", jwksUrl, remote.Len()))
+	ks.remote = remote
+	return ks.remote
+}
+
+// jwksUrl returns AUTH_JWKS_URL, if set, otherwise the jwks_uri from the
+// issuer's OpenID Connect discovery document
+func (ks *keySet) jwksUrl() (string, error) {
+	if jwksUrl := os.Getenv(_authJwksUrlEnv); jwksUrl != "" {
+		return jwksUrl, nil
+	}
+	if ks.issuer == "" {
+		return "", fmt.Errorf("neither %s nor %s is set", _authJwksUrlEnv, _authIssuerEnv)
+	}
+
+	discoveryUrl := strings.TrimSuffix(ks.issuer, "/") + "/.well-known/openid-configuration"
+	ctx, cancel := context.WithTimeout(context.Background(), _jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := ks.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s responded %d", discoveryUrl, res.StatusCode)
+	}
+
+	var discovery struct {
+		JwksUri string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&discovery); err != nil {
+		return "", fmt.Errorf("invalid discovery document %s: %w", discoveryUrl, err)
+	}
+	if discovery.JwksUri == "" {
+		return "", fmt.Errorf("no jwks_uri in %s", discoveryUrl)
+	}
+	return discovery.JwksUri, nil
+}
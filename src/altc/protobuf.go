@@ -0,0 +1,225 @@
+package altc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// Field numbers of the envelope messages (see snapshot.proto)
+const (
+	_snapshotClusterNameField  protowire.Number = 1
+	_snapshotSnapshotIdField   protowire.Number = 2
+	_snapshotPendingKindsField protowire.Number = 3
+	_snapshotDataField         protowire.Number = 4
+	_snapshotSequenceField     protowire.Number = 5
+	_snapshotBatchIdField      protowire.Number = 6
+	_snapshotCommitField       protowire.Number = 7
+	_snapshotClusterInfoField  protowire.Number = 8
+	_snapshotRecordsField      protowire.Number = 9
+
+	_commitBatchesField  protowire.Number = 1
+	_commitReplacedField protowire.Number = 2
+
+	_clusterInfoClusterIdField     protowire.Number = 1
+	_clusterInfoServerVersionField protowire.Number = 2
+	_clusterInfoPlatformField      protowire.Number = 3
+	_clusterInfoNodeCountField     protowire.Number = 4
+
+	_recordTypeField protowire.Number = 1
+	_recordDataField protowire.Number = 2
+
+	_itemActionField       protowire.Number = 1
+	_itemKindField         protowire.Number = 2
+	_itemPayloadField      protowire.Number = 3
+	_itemMetadataOnlyField protowire.Number = 4
+	_itemTruncatedField    protowire.Number = 5
+	_itemFindingsField     protowire.Number = 6
+
+	_findingRuleField      protowire.Number = 1
+	_findingSeverityField  protowire.Number = 2
+	_findingMessageField   protowire.Number = 3
+	_findingContainerField protowire.Number = 4
+)
+
+var k8sProtobufSerializer = protobuf.NewSerializer(scheme.Scheme, scheme.Scheme)
+
+// protoMarshaler is implemented by the Kubernetes API types
+type protoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// encodeProtobuf encodes the snapshot object with the envelope schema in snapshot.proto
+func encodeProtobuf(snapshotObject *SnapshotObject) ([]byte, error) {
+	var b []byte
+	b = appendString(b, _snapshotClusterNameField, snapshotObject.ClusterName)
+	b = appendString(b, _snapshotSnapshotIdField, string(snapshotObject.SnapshotId))
+	for _, pendingKind := range snapshotObject.PendingKinds {
+		b = appendString(b, _snapshotPendingKindsField, pendingKind)
+	}
+
+	if snapshotObject.Sequence != 0 {
+		b = protowire.AppendTag(b, _snapshotSequenceField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(snapshotObject.Sequence))
+	}
+	b = appendString(b, _snapshotBatchIdField, snapshotObject.BatchId)
+
+	for _, item := range snapshotObject.Data {
+		itemBytes, err := encodeItemProtobuf(item)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, _snapshotDataField, protowire.BytesType)
+		b = protowire.AppendBytes(b, itemBytes)
+	}
+
+	if snapshotObject.Commit != nil {
+		var commit []byte
+		commit = protowire.AppendTag(commit, _commitBatchesField, protowire.VarintType)
+		commit = protowire.AppendVarint(commit, uint64(snapshotObject.Commit.Batches))
+		if replaced := snapshotObject.Commit.Replaced; len(replaced) > 0 {
+			var packed []byte
+			for _, sequence := range replaced {
+				packed = protowire.AppendVarint(packed, uint64(sequence))
+			}
+			commit = protowire.AppendTag(commit, _commitReplacedField, protowire.BytesType)
+			commit = protowire.AppendBytes(commit, packed)
+		}
+		b = protowire.AppendTag(b, _snapshotCommitField, protowire.BytesType)
+		b = protowire.AppendBytes(b, commit)
+	}
+
+	if clusterInfo := snapshotObject.ClusterInfo; clusterInfo != nil {
+		var info []byte
+		info = appendString(info, _clusterInfoClusterIdField, clusterInfo.ClusterId)
+		info = appendString(info, _clusterInfoServerVersionField, clusterInfo.ServerVersion)
+		info = appendString(info, _clusterInfoPlatformField, clusterInfo.Platform)
+		if clusterInfo.NodeCount != 0 {
+			info = protowire.AppendTag(info, _clusterInfoNodeCountField, protowire.VarintType)
+			info = protowire.AppendVarint(info, uint64(clusterInfo.NodeCount))
+		}
+		b = protowire.AppendTag(b, _snapshotClusterInfoField, protowire.BytesType)
+		b = protowire.AppendBytes(b, info)
+	}
+
+	for _, record := range snapshotObject.Records {
+		recordBytes, err := encodeRecordProtobuf(record)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, _snapshotRecordsField, protowire.BytesType)
+		b = protowire.AppendBytes(b, recordBytes)
+	}
+
+	return b, nil
+}
+
+func encodeRecordProtobuf(record *Record) ([]byte, error) {
+	data, err := json.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	b = appendString(b, _recordTypeField, record.Type)
+	b = protowire.AppendTag(b, _recordDataField, protowire.BytesType)
+	b = protowire.AppendBytes(b, data)
+	return b, nil
+}
+
+func encodeItemProtobuf(item *ClusterObjectItem) ([]byte, error) {
+	payload, err := encodePayloadProtobuf(item.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode %s %s/%s: %w",
+			item.Kind, item.Payload.GetNamespace(), item.Payload.GetName(), err)
+	}
+
+	var b []byte
+	b = appendString(b, _itemActionField, string(item.Action))
+	b = appendString(b, _itemKindField, item.Kind)
+	b = protowire.AppendTag(b, _itemPayloadField, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	b = appendBool(b, _itemMetadataOnlyField, item.MetadataOnly)
+	b = appendBool(b, _itemTruncatedField, item.Truncated)
+	for _, finding := range item.Findings {
+		var findingBytes []byte
+		findingBytes = appendString(findingBytes, _findingRuleField, finding.Rule)
+		findingBytes = appendString(findingBytes, _findingSeverityField, finding.Severity)
+		findingBytes = appendString(findingBytes, _findingMessageField, finding.Message)
+		findingBytes = appendString(findingBytes, _findingContainerField, finding.Container)
+		b = protowire.AppendTag(b, _itemFindingsField, protowire.BytesType)
+		b = protowire.AppendBytes(b, findingBytes)
+	}
+	return b, nil
+}
+
+// encodePayloadProtobuf
+//
+// Encodes the object with the Kubernetes protobuf serializer. Objects from the
+// informers' caches don't carry their group/version/kind, so the object is
+// wrapped in a runtime.Unknown with the kind from the scheme rather than
+// setting the kind on the (shared) object.
+func encodePayloadProtobuf(resourceObject ResourceObject) ([]byte, error) {
+	marshaler, ok := resourceObject.(protoMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support protobuf encoding", resourceObject)
+	}
+
+	gvk, err := objectGroupVersionKind(resourceObject)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := marshaler.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	unknown := &runtime.Unknown{
+		TypeMeta: runtime.TypeMeta{
+			APIVersion: gvk.GroupVersion().String(),
+			Kind:       gvk.Kind,
+		},
+		Raw:         raw,
+		ContentType: runtime.ContentTypeProtobuf,
+	}
+
+	var buf bytes.Buffer
+	if err := k8sProtobufSerializer.Encode(unknown, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func objectGroupVersionKind(resourceObject ResourceObject) (schema.GroupVersionKind, error) {
+	if _, ok := resourceObject.(*metav1.PartialObjectMetadata); ok {
+		return metav1.SchemeGroupVersion.WithKind("PartialObjectMetadata"), nil
+	}
+
+	kinds, _, err := scheme.Scheme.ObjectKinds(resourceObject)
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	return kinds[0], nil
+}
+
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendBool(b []byte, num protowire.Number, value bool) []byte {
+	if !value {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(value))
+}
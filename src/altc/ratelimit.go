@@ -0,0 +1,126 @@
+package altc
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"io"
+	"sync"
+)
+
+const (
+	// Request rate used once the server starts throttling when no rate is configured
+	_throttledRequestRate = rate.Limit(1)
+	_minRequestRate       = rate.Limit(0.1)
+	// When no rate is configured, the request rate is no longer limited once
+	// it has recovered to this rate
+	_unthrottledRequestRate = rate.Limit(10)
+	// Factor the request rate grows by after each successful request, until
+	// it is back to the configured rate
+	_requestRateRecovery = 1.1
+)
+
+// rateLimiter
+//
+// Paces requests to the server using token buckets for the request rate and
+// the upload bandwidth. The request rate is halved each time the server
+// throttles a request (429) and recovers gradually as requests succeed.
+type rateLimiter struct {
+	mu sync.Mutex
+	// Configured request rate, rate.Inf if not limited
+	maxRequestRate rate.Limit
+	requests       *rate.Limiter
+	// nil if the bandwidth is not limited
+	bytes *rate.Limiter
+}
+
+func newRateLimiter(requestsPerSecond float64, bytesPerSecond int) *rateLimiter {
+	maxRequestRate := rate.Inf
+	if requestsPerSecond > 0 {
+		maxRequestRate = rate.Limit(requestsPerSecond)
+	}
+
+	limiter := &rateLimiter{
+		maxRequestRate: maxRequestRate,
+		requests:       rate.NewLimiter(maxRequestRate, 1),
+	}
+	if bytesPerSecond > 0 {
+		// Allow up to a second's worth of bytes at once
+		limiter.bytes = rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond)
+	}
+	return limiter
+}
+
+// waitRequest blocks until a request can be made
+func (l *rateLimiter) waitRequest(ctx context.Context) error {
+	return l.requests.Wait(ctx)
+}
+
+// waitBytes blocks until 'n' bytes can be sent
+func (l *rateLimiter) waitBytes(ctx context.Context, n int) error {
+	if l.bytes == nil {
+		return nil
+	}
+
+	for n > 0 {
+		chunk := n
+		if burst := l.bytes.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := l.bytes.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// throttled slows down requests after the server has throttled a request
+func (l *rateLimiter) throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	requestRate := l.requests.Limit()
+	if requestRate == rate.Inf {
+		requestRate = _throttledRequestRate
+	} else {
+		requestRate /= 2
+	}
+	if requestRate < _minRequestRate {
+		requestRate = _minRequestRate
+	}
+
+	fmt.Println(fmt.Sprintf("requests throttled by the server, limiting requests to %.2f/s", float64(requestRate)))
+	l.requests.SetLimit(requestRate)
+}
+
+// succeeded speeds requests back up after the server has throttled requests
+func (l *rateLimiter) succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	requestRate := l.requests.Limit()
+	if requestRate == l.maxRequestRate {
+		return
+	}
+
+	requestRate *= _requestRateRecovery
+	if requestRate >= l.maxRequestRate || (l.maxRequestRate == rate.Inf && requestRate >= _unthrottledRequestRate) {
+		requestRate = l.maxRequestRate
+	}
+	l.requests.SetLimit(requestRate)
+}
+
+// rateLimitedWriter limits the rate at which bytes are written
+type rateLimitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	if err := w.limiter.waitBytes(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
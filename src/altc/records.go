@@ -0,0 +1,274 @@
+package altc
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"time"
+)
+
+// Types of records
+const (
+	RelationshipRecordType = "relationship"
+	ImageRecordType        = "image"
+	PermissionsRecordType  = "permissions"
+	NodeCapacityRecordType = "nodeCapacity"
+	// Resources allocated to the Pods of a namespace
+	NamespaceAllocationRecordType = "namespaceAllocation"
+	NodeCostRecordType            = "nodeCost"
+	// Cost of the Pods of a namespace, workload or label value
+	CostAllocationRecordType = "costAllocation"
+	ClusterCostRecordType    = "clusterCost"
+	// Resource usage reported by the metrics.k8s.io API
+	NodeUsageRecordType = "nodeUsage"
+	PodUsageRecordType  = "podUsage"
+)
+
+// Record
+//
+// Information derived by the agent from a snapshot's objects, sent after
+// the objects in batches of their own. Type identifies the kind of record
+// and the shape of Data.
+type Record struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// ObjectRef identifies a cluster object, or an RBAC subject, in a record
+type ObjectRef struct {
+	Kind      string       `json:"kind"`
+	Namespace string       `json:"namespace,omitempty"`
+	Name      string       `json:"name"`
+	UID       k8stypes.UID `json:"uid,omitempty"`
+}
+
+// Types of relationships
+const (
+	// An owner and an object it owns (owner references)
+	OwnsRelationship = "owns"
+	// A Service, NetworkPolicy or PodDisruptionBudget and a Pod it selects
+	SelectsRelationship = "selects"
+	// A Service and its Endpoints
+	ExposesRelationship = "exposes"
+	// Endpoints and a Pod they target
+	TargetsRelationship = "targets"
+	// A Pod and a PersistentVolumeClaim, ConfigMap or Secret it mounts
+	MountsRelationship = "mounts"
+	// A PersistentVolumeClaim and the PersistentVolume it is bound to
+	BoundRelationship = "bound"
+	// A Pod and its ServiceAccount
+	RunsAsRelationship = "runsAs"
+	// A RoleBinding or ClusterRoleBinding and the Role or ClusterRole it grants
+	GrantsRelationship = "grants"
+	// A RoleBinding or ClusterRoleBinding and a subject it binds
+	BindsRelationship = "binds"
+)
+
+// Relationship is an edge of the graph of the cluster's objects
+type Relationship struct {
+	Type string    `json:"type"`
+	From ObjectRef `json:"from"`
+	To   ObjectRef `json:"to"`
+}
+
+// Types of containers running an image
+const (
+	InitContainerType      = "init"
+	RegularContainerType   = "regular"
+	EphemeralContainerType = "ephemeral"
+)
+
+// Image
+//
+// An image referenced by the cluster's Pods or workload templates. Image is
+// the normalized reference (registry, repository and tag or digest, e.g.
+// docker.io/library/nginx:1.25); Digests are the digests of the image the
+// Pods' containers are running, as reported by the container runtime.
+type Image struct {
+	Image      string   `json:"image"`
+	Registry   string   `json:"registry"`
+	Repository string   `json:"repository"`
+	Tag        string   `json:"tag,omitempty"`
+	Digest     string   `json:"digest,omitempty"`
+	Digests    []string `json:"digests,omitempty"`
+	// Types of containers referencing the image: init, regular or ephemeral
+	ContainerTypes []string `json:"containerTypes"`
+	// Workloads (or Pods without an owner) referencing the image
+	Workloads  []ObjectRef `json:"workloads"`
+	Namespaces []string    `json:"namespaces"`
+	// Number of Pods running the image
+	Pods int `json:"pods"`
+}
+
+// SubjectPermissions
+//
+// The effective RBAC permissions of a subject (a User, Group or
+// ServiceAccount): the verbs it is granted on each resource, in each
+// namespace, by all of the bindings naming it, and the permissions among
+// them that allow escalating privileges.
+type SubjectPermissions struct {
+	Subject     ObjectRef    `json:"subject"`
+	Permissions []Permission `json:"permissions"`
+	Escalations []Escalation `json:"escalations,omitempty"`
+}
+
+// AllNamespaces is the namespace of permissions granted in all namespaces (by ClusterRoleBindings)
+const AllNamespaces = "*"
+
+// Permission is the verbs granted on a resource, or a non-resource URL, in a namespace
+type Permission struct {
+	Namespace      string   `json:"namespace"`
+	APIGroup       string   `json:"apiGroup,omitempty"`
+	Resource       string   `json:"resource,omitempty"`
+	ResourceNames  []string `json:"resourceNames,omitempty"`
+	NonResourceURL string   `json:"nonResourceURL,omitempty"`
+	Verbs          []string `json:"verbs"`
+}
+
+// Types of escalations
+const (
+	// Binding Roles or ClusterRoles, and so granting any permission they hold
+	BindEscalation = "bind"
+	// Creating or updating Roles or ClusterRoles with permissions the subject doesn't hold
+	EscalateEscalation = "escalate"
+	// Acting as other users, groups or service accounts
+	ImpersonateEscalation = "impersonate"
+	// Reading Secrets, including service account tokens
+	ReadSecretsEscalation = "readSecrets"
+)
+
+// Escalation is a permission allowing a subject to escalate its privileges
+type Escalation struct {
+	Type      string `json:"type"`
+	Namespace string `json:"namespace"`
+}
+
+// ResourceAmounts are amounts of the compute resources
+type ResourceAmounts struct {
+	CPUMillicores         int64 `json:"cpuMillicores"`
+	MemoryBytes           int64 `json:"memoryBytes"`
+	EphemeralStorageBytes int64 `json:"ephemeralStorageBytes"`
+}
+
+// NodeCapacity
+//
+// A node's capacity and the resources allocated on it: the sum of the
+// requests and limits of the Pods running on the node (Pods that have
+// completed are not counted), with the node's taints and conditions.
+// Containers without a limit don't contribute to Limits.
+type NodeCapacity struct {
+	Node        ObjectRef       `json:"node"`
+	Capacity    ResourceAmounts `json:"capacity"`
+	Allocatable ResourceAmounts `json:"allocatable"`
+	Requested   ResourceAmounts `json:"requested"`
+	Limits      ResourceAmounts `json:"limits"`
+	Pods        int             `json:"pods"`
+	MaxPods     int64           `json:"maxPods"`
+	// Taints, as "<key>[=<value>]:<effect>"
+	Taints        []string `json:"taints,omitempty"`
+	Unschedulable bool     `json:"unschedulable,omitempty"`
+	// Status of each of the node's conditions, e.g. "Ready": "True"
+	Conditions map[string]string `json:"conditions"`
+}
+
+// NamespaceAllocation is the sum of the requests and limits of a namespace's Pods that have not completed
+type NamespaceAllocation struct {
+	Namespace string          `json:"namespace"`
+	Requested ResourceAmounts `json:"requested"`
+	Limits    ResourceAmounts `json:"limits"`
+	Pods      int             `json:"pods"`
+}
+
+// Groupings of the costs of Pods
+const (
+	NamespaceCostGroup = "namespace"
+	WorkloadCostGroup  = "workload"
+	LabelCostGroup     = "label"
+)
+
+// NodeCost
+//
+// A node's hourly price, split between the cost allocated to the Pods
+// running on it, in proportion to their requests, and its idle cost. The
+// price of a node whose instance type has no configured price is unknown.
+type NodeCost struct {
+	Node         ObjectRef `json:"node"`
+	InstanceType string    `json:"instanceType,omitempty"`
+	HourlyPrice  float64   `json:"hourlyPrice"`
+	Allocated    float64   `json:"allocated"`
+	Idle         float64   `json:"idle"`
+	Unpriced     bool      `json:"unpriced,omitempty"`
+}
+
+// CostAllocation
+//
+// The hourly cost allocated to the Pods of a namespace, a workload (Pods
+// are attributed to their Deployment, StatefulSet, DaemonSet, CronJob, ...)
+// or a value of a label, with the resources they request.
+type CostAllocation struct {
+	// One of the cost groups, e.g. "namespace"
+	GroupBy   string          `json:"groupBy"`
+	Namespace string          `json:"namespace,omitempty"`
+	Workload  *ObjectRef      `json:"workload,omitempty"`
+	Label     string          `json:"label,omitempty"`
+	Value     string          `json:"value,omitempty"`
+	Cost      float64         `json:"cost"`
+	Requested ResourceAmounts `json:"requested"`
+	Pods      int             `json:"pods"`
+}
+
+// ClusterCost is the hourly cost of the cluster's priced nodes
+type ClusterCost struct {
+	HourlyPrice float64 `json:"hourlyPrice"`
+	Allocated   float64 `json:"allocated"`
+	Idle        float64 `json:"idle"`
+	// Nodes without a configured price, whose cost is not included
+	UnpricedNodes []string `json:"unpricedNodes,omitempty"`
+}
+
+// NodeUsage
+//
+// A node's resource usage, as reported by the metrics.k8s.io API (e.g. by
+// metrics-server), averaged over the window ending at the timestamp, with
+// its allocatable resources and those requested by the Pods running on it.
+type NodeUsage struct {
+	Node          ObjectRef       `json:"node"`
+	Timestamp     time.Time       `json:"timestamp"`
+	WindowSeconds float64         `json:"windowSeconds"`
+	Usage         ResourceAmounts `json:"usage"`
+	Allocatable   ResourceAmounts `json:"allocatable"`
+	Requested     ResourceAmounts `json:"requested"`
+}
+
+// PodUsage is a Pod's resource usage, as reported by the metrics.k8s.io API, with its requests and limits
+type PodUsage struct {
+	Pod           ObjectRef        `json:"pod"`
+	Node          string           `json:"node,omitempty"`
+	Timestamp     time.Time        `json:"timestamp"`
+	WindowSeconds float64          `json:"windowSeconds"`
+	Usage         ResourceAmounts  `json:"usage"`
+	Requested     ResourceAmounts  `json:"requested"`
+	Limits        ResourceAmounts  `json:"limits"`
+	Containers    []ContainerUsage `json:"containers"`
+}
+
+type ContainerUsage struct {
+	Name      string          `json:"name"`
+	Usage     ResourceAmounts `json:"usage"`
+	Requested ResourceAmounts `json:"requested"`
+	Limits    ResourceAmounts `json:"limits"`
+}
+
+// NewRecordsBatchId
+//
+// Returns a deterministic identifier for a batch of records of a snapshot:
+// the snapshot id, the batch's sequence number and a hash of the records.
+func NewRecordsBatchId(snapshotId k8stypes.UID, sequence int, records []*Record) string {
+	hash := sha256.New()
+	encoder := json.NewEncoder(hash)
+	for _, record := range records {
+		_ = encoder.Encode(record)
+	}
+	return fmt.Sprintf("%s-%d-records-%x", snapshotId, sequence, hash.Sum(nil)[:8])
+}
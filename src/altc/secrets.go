@@ -0,0 +1,118 @@
+package altc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets
+//
+// Credential values (e.g. AUTH_SECRET, AUTH_API_KEY) kept in a Kubernetes
+// Secret, read through the API or from the Secret's mounted files, and
+// updated as the Secret changes so credentials are rotated without
+// restarting. Keys of the Secret are the names of the environment variables
+// they replace; values not in the Secret are read from the environment.
+type Secrets struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+	// Called when the values change
+	listeners []func()
+}
+
+func NewSecrets() *Secrets {
+	return &Secrets{values: make(map[string][]byte)}
+}
+
+// Get returns the value of the key from the Secret, or from the environment
+func (s *Secrets) Get(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if value, ok := s.values[key]; ok {
+		return strings.TrimSpace(string(value))
+	}
+	return os.Getenv(key)
+}
+
+// OnChange registers a function called when the values change
+func (s *Secrets) OnChange(listener func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// Update replaces the values, notifying the listeners if they have changed
+func (s *Secrets) Update(values map[string][]byte) {
+	s.mu.Lock()
+	changed := len(values) != len(s.values)
+	for key, value := range values {
+		if current, ok := s.values[key]; !ok || !bytes.Equal(current, value) {
+			changed = true
+		}
+	}
+	s.values = values
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	fmt.Println(fmt.Sprintf("credentials updated: %s", strings.Join(keys, ", ")))
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+// LoadDir updates the values from a mounted Secret: a file per key
+func (s *Secrets) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string][]byte)
+	for _, entry := range entries {
+		// Skip the directories and symlinks of the atomic writer ('..data', '..<timestamp>')
+		if strings.HasPrefix(entry.Name(), "..") {
+			continue
+		}
+		value, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			if info, statErr := os.Stat(filepath.Join(dir, entry.Name())); statErr == nil && info.IsDir() {
+				continue
+			}
+			return err
+		}
+		values[entry.Name()] = value
+	}
+
+	s.Update(values)
+	return nil
+}
+
+// WatchDir reloads the values from a mounted Secret every 'interval' until the context is done
+func (s *Secrets) WatchDir(ctx context.Context, dir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.LoadDir(dir); err != nil {
+				fmt.Println(fmt.Sprintf("WARN: unable to reload credentials from %s: %s", dir, err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package altc
+
+import (
+	"bytes"
+	"encoding/json"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// EncodedSize returns the size of the snapshot object's encoding, before compression
+func EncodedSize(snapshotObject *SnapshotObject, encoding Encoding) (int, error) {
+	var buffer bytes.Buffer
+	if err := encode(&buffer, snapshotObject, encoding); err != nil {
+		return 0, err
+	}
+	return buffer.Len(), nil
+}
+
+// EncodedItemSize
+//
+// Returns the number of bytes the item adds to the encoding of a snapshot
+// object: the item's encoding and its framing within the snapshot object's
+// data (a separating comma in json, the field's tag and length in protobuf).
+func EncodedItemSize(item *ClusterObjectItem, encoding Encoding) (int, error) {
+	if encoding == ProtobufEncoding {
+		itemBytes, err := encodeItemProtobuf(item)
+		if err != nil {
+			return 0, err
+		}
+		return protowire.SizeTag(_snapshotDataField) + protowire.SizeBytes(len(itemBytes)), nil
+	}
+
+	itemBytes, err := json.Marshal(item)
+	if err != nil {
+		return 0, err
+	}
+	return len(itemBytes) + len(","), nil
+}
+
+// EncodedRecordSize returns the number of bytes the record adds to the
+// encoding of a snapshot object's records (see EncodedItemSize)
+func EncodedRecordSize(record *Record, encoding Encoding) (int, error) {
+	if encoding == ProtobufEncoding {
+		recordBytes, err := encodeRecordProtobuf(record)
+		if err != nil {
+			return 0, err
+		}
+		return protowire.SizeTag(_snapshotRecordsField) + protowire.SizeBytes(len(recordBytes)), nil
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	return len(recordBytes) + len(","), nil
+}
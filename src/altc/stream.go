@@ -0,0 +1,253 @@
+package altc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"os"
+	"time"
+)
+
+const _ndjsonContentType = "application/x-ndjson"
+
+// StreamCheckpoint
+//
+// Written to a streamed snapshot every checkpoint interval, after the
+// compressed stream has been flushed, so the server can track progress.
+type StreamCheckpoint struct {
+	Sequence int `json:"sequence"`
+	// Number of items written before the checkpoint
+	Items int `json:"items"`
+	// Number of records written before the checkpoint
+	Records int `json:"records,omitempty"`
+	// Set on the last checkpoint, written once all of the items have been written
+	Final bool `json:"final,omitempty"`
+}
+
+// streamHeader is the first line of a streamed snapshot: the snapshot object
+// without its data, which follows as separate lines
+type streamHeader struct {
+	*SnapshotObject
+	// Shadows SnapshotObject.Data
+	Data *struct{} `json:"data,omitempty"`
+}
+
+type streamRecordLine struct {
+	Record *Record `json:"record"`
+}
+
+type streamCheckpointLine struct {
+	Checkpoint *StreamCheckpoint `json:"checkpoint"`
+}
+
+// StreamSource supplies the items and records of a streamed snapshot
+type StreamSource interface {
+	// Next returns the next item, a nil item once there are no more items, or
+	// an error to abort the request
+	Next() (*ClusterObjectItem, error)
+	// Records is called once Next has returned the last item
+	Records() []*Record
+	// Close discards the items that were not streamed; an error aborts retries
+	Close() error
+}
+
+// SendStream
+//
+// Sends a whole snapshot in a single chunked request, as newline delimited
+// json: the snapshot object (without data) followed by a line per cluster
+// object item of the source returned by 'open', with a checkpoint line every
+// 'checkpointInterval' items, a line per record once all of the items have
+// been written, and a final checkpoint at the end. Items are written as they
+// are returned, so the snapshot is never held in memory. Failures are
+// classified and retried as by Send, with a new source for each attempt
+// since the items of a source are consumed by the attempt. The upload is
+// paced by the configured bandwidth limit.
+func (c *Client) SendStream(ctx context.Context, snapshotObject *SnapshotObject, open func() StreamSource, checkpointInterval int) (*SendStats, error) {
+	backoff := newSendBackoff()
+	reauthenticated := false
+	for attempt := 1; ; attempt++ {
+		source := open()
+		compression := c.requestCompression()
+		stats, response, err := c.sendStream(ctx, snapshotObject, source, compression, checkpointInterval)
+		if closeErr := source.Close(); closeErr != nil {
+			return nil, closeErr
+		}
+		if err == nil {
+			return stats, nil
+		}
+
+		var sendError *SendError
+		if !errors.As(err, &sendError) {
+			// Not a failure to send (e.g. the source was aborted)
+			return nil, err
+		}
+		fmt.Println(fmt.Sprintf("error streaming snapshot on attempt %d: %s", attempt, err))
+
+		if response != nil {
+			// The server doesn't support the compression, retry with a supported one
+			if response.StatusCode == http.StatusUnsupportedMediaType && c.negotiate(response.Header, JSONEncoding, compression) {
+				continue
+			}
+			if sendError.Kind == UnauthorizedSendError && !reauthenticated {
+				reauthenticated = true
+				if err := c.reauthenticate(ctx); err == nil {
+					continue
+				}
+			}
+		}
+
+		if sendError.Kind != RetryableSendError || attempt >= _maxSendAttempts {
+			return nil, sendError
+		}
+
+		delay := backoff.Step()
+		if sendError.RetryAfter > 0 {
+			delay = sendError.RetryAfter
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, sendError
+		}
+	}
+}
+
+// sendStream makes a single attempt at streaming the snapshot, returning the response if one was received
+func (c *Client) sendStream(ctx context.Context, snapshotObject *SnapshotObject, source StreamSource, compression Compression, checkpointInterval int) (*SendStats, *http.Response, error) {
+	if err := c.limiter.waitRequest(ctx); err != nil {
+		return nil, nil, limiterError(err)
+	}
+
+	credential, err := c.credentials.get(ctx, false)
+	if err != nil {
+		return nil, nil, credentialError(err)
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	stats := &SendStats{Compression: compression}
+	encodeErr := make(chan error, 1)
+	go func() {
+		cw := &countingWriter{w: &rateLimitedWriter{ctx: ctx, w: pw, limiter: c.limiter}}
+		zw, err := compression.newWriter(cw)
+		if err == nil {
+			err = writeStream(zw, snapshotObject, source, checkpointInterval, stats)
+		}
+		if err == nil {
+			err = zw.Close()
+		}
+		stats.CompressedBytes = cw.count
+		encodeErr <- err
+		pw.CloseWithError(err)
+	}()
+
+	url := os.Getenv(_serverUrlEnv)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, pr)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", _ndjsonContentType)
+	req.Header.Set(credential.Header, credential.Value)
+	setContentEncoding(req.Header, compression)
+	// Lets the server discard a snapshot it has already received, without
+	// colliding with the keys of the batches of a snapshot (see NewBatchId)
+	req.Header.Set(_idempotencyKeyHeader, streamIdempotencyKey(snapshotObject.SnapshotId))
+
+	fmt.Println(fmt.Sprintf("streaming snapshot %s", snapshotObject.SnapshotId))
+	res, err := c.httpClient.Do(req)
+
+	// Wait for the writer to finish, so the source is no longer read once
+	// this returns. The request body has been fully read unless the request
+	// failed (or the server responded early), in which case closing the pipe
+	// fails the writer.
+	pr.Close()
+	writeErr := <-encodeErr
+
+	if err != nil {
+		// An error of the source aborts the request
+		if writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
+			return nil, nil, writeErr
+		}
+		return nil, nil, transportError(fmt.Errorf("error streaming snapshot: %w", err))
+	}
+	defer res.Body.Close()
+
+	if writeErr != nil && !errors.Is(writeErr, io.ErrClosedPipe) {
+		return nil, nil, fmt.Errorf("error encoding snapshot stream: %w", writeErr)
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		c.limiter.throttled()
+	}
+	body, _ := io.ReadAll(res.Body)
+	if sendError := responseError(res, body); sendError != nil {
+		return nil, res, sendError
+	}
+	c.limiter.succeeded()
+
+	fmt.Println(fmt.Sprintf("streamed snapshot: %d bytes, %d bytes compressed (%s, ratio %.2f)",
+		stats.Bytes, stats.CompressedBytes, compression, stats.CompressionRatio()))
+	return stats, res, nil
+}
+
+// streamIdempotencyKey returns the idempotency key of a streamed snapshot
+func streamIdempotencyKey(snapshotId k8stypes.UID) string {
+	return fmt.Sprintf("%s/stream", snapshotId)
+}
+
+func writeStream(zw compressWriter, snapshotObject *SnapshotObject, source StreamSource, checkpointInterval int, stats *SendStats) error {
+	cw := &countingWriter{w: zw}
+	encoder := json.NewEncoder(cw)
+	defer func() { stats.Bytes = cw.count }()
+
+	if err := encoder.Encode(streamHeader{SnapshotObject: snapshotObject}); err != nil {
+		return err
+	}
+
+	checkpoint := &StreamCheckpoint{}
+	writeCheckpoint := func() error {
+		checkpoint.Sequence++
+		if err := encoder.Encode(streamCheckpointLine{Checkpoint: checkpoint}); err != nil {
+			return err
+		}
+		// Send what has been compressed so far, so the server can process
+		// the items up to the checkpoint
+		return zw.Flush()
+	}
+
+	for {
+		item, err := source.Next()
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			break
+		}
+
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+		checkpoint.Items++
+
+		if checkpointInterval > 0 && checkpoint.Items%checkpointInterval == 0 {
+			if err := writeCheckpoint(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, record := range source.Records() {
+		if err := encoder.Encode(streamRecordLine{Record: record}); err != nil {
+			return err
+		}
+		checkpoint.Records++
+	}
+
+	checkpoint.Final = true
+	return writeCheckpoint()
+}
@@ -0,0 +1,158 @@
+package altc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// newTestClient returns a client sending to the server, authenticated with an api key
+func newTestClient(t *testing.T, server *httptest.Server) *Client {
+	t.Helper()
+	t.Setenv(_serverUrlEnv, server.URL)
+	t.Setenv(_serverCompressionEnv, IdentityCodec)
+	t.Setenv(_authProviderEnv, _apiKeyAuthProvider)
+	t.Setenv(_authApiKeyEnv, "key")
+	client, err := NewClient(NewSecrets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// testStreamSource streams the items, counting those read
+type testStreamSource struct {
+	items  []*ClusterObjectItem
+	read   int
+	closed bool
+}
+
+func (s *testStreamSource) Next() (*ClusterObjectItem, error) {
+	if s.read == len(s.items) {
+		return nil, nil
+	}
+	s.read++
+	return s.items[s.read-1], nil
+}
+
+func (s *testStreamSource) Records() []*Record {
+	return []*Record{{Type: "test"}}
+}
+
+func (s *testStreamSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+func testItems(t *testing.T, count int) []*ClusterObjectItem {
+	t.Helper()
+	items := make([]*ClusterObjectItem, 0, count)
+	for i := 0; i < count; i++ {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"}}
+		item, err := NewClusterObjectItem(Add, pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func TestSendStreamRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		// Kind of the error returned, "" if the stream is sent
+		want     SendErrorKind
+		attempts int
+	}{
+		{name: "sent", statuses: []int{http.StatusOK}, attempts: 1},
+		{name: "retried", statuses: []int{http.StatusServiceUnavailable, http.StatusConflict, http.StatusOK}, attempts: 3},
+		{name: "permanent", statuses: []int{http.StatusBadRequest}, want: PermanentSendError, attempts: 1},
+		{name: "retries exhausted", statuses: []int{500, 500, 500, 500, 500}, want: RetryableSendError, attempts: _maxSendAttempts},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var keys []string
+			lines := make([]int, 0)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				keys = append(keys, r.Header.Get(_idempotencyKeyHeader))
+				count := 0
+				for scanner := bufio.NewScanner(r.Body); scanner.Scan(); {
+					count++
+				}
+				lines = append(lines, count)
+				w.WriteHeader(test.statuses[len(keys)-1])
+			}))
+			defer server.Close()
+			client := newTestClient(t, server)
+
+			var sources []*testStreamSource
+			open := func() StreamSource {
+				source := &testStreamSource{items: testItems(t, 3)}
+				sources = append(sources, source)
+				return source
+			}
+			_, err := client.SendStream(context.Background(), &SnapshotObject{SnapshotId: "snapshot"}, open, 0)
+
+			if kind := SendErrorKindOf(err); kind != test.want {
+				t.Errorf("error = %v, want kind %q", err, test.want)
+			}
+			if len(sources) != test.attempts || len(keys) != test.attempts {
+				t.Fatalf("%d sources opened, %d requests, want %d", len(sources), len(keys), test.attempts)
+			}
+			for i, source := range sources {
+				if !source.closed {
+					t.Errorf("source %d was not closed", i)
+				}
+				// The header, the items, a record and the final checkpoint
+				if lines[i] != 6 {
+					t.Errorf("attempt %d streamed %d lines, want 6", i, lines[i])
+				}
+				if keys[i] != "snapshot/stream" {
+					t.Errorf("attempt %d idempotency key = %q, want %q", i, keys[i], "snapshot/stream")
+				}
+			}
+		})
+	}
+}
+
+func TestSendStreamSourceError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for scanner := bufio.NewScanner(r.Body); scanner.Scan(); {
+		}
+	}))
+	defer server.Close()
+	client := newTestClient(t, server)
+
+	abort := errors.New("aborted")
+	opened := 0
+	open := func() StreamSource {
+		opened++
+		return &failingStreamSource{err: abort}
+	}
+	if _, err := client.SendStream(context.Background(), &SnapshotObject{SnapshotId: "snapshot"}, open, 0); !errors.Is(err, abort) {
+		t.Errorf("error = %v, want %v", err, abort)
+	}
+	if opened != 1 {
+		t.Errorf("%d sources opened, want 1: an aborted stream is not retried", opened)
+	}
+}
+
+type failingStreamSource struct {
+	testStreamSource
+	err error
+}
+
+func (s *failingStreamSource) Next() (*ClusterObjectItem, error) {
+	return nil, s.err
+}
@@ -0,0 +1,196 @@
+package altc
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PEM bundle of the CAs trusted in addition to the system roots
+	_tlsCABundleFileEnv = "TLS_CA_BUNDLE_FILE"
+	// Client certificate and key presented to the servers (mutual TLS),
+	// typically mounted from a Secret; reloaded when they change
+	_tlsClientCertFileEnv = "TLS_CLIENT_CERT_FILE"
+	_tlsClientKeyFileEnv  = "TLS_CLIENT_KEY_FILE"
+	// "1.2" (default) or "1.3"
+	_tlsMinVersionEnv = "TLS_MIN_VERSION"
+	// Comma separated base64 sha256 hashes of the public keys (SPKI) of which
+	// the servers' certificate chains must include at least one
+	_tlsPinnedPublicKeysEnv = "TLS_PINNED_PUBLIC_KEYS"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newHTTPClient
+//
+// Returns the http client used for the requests to the auth and ingest
+// servers, configured with the TLS and egress (see configureEgress) settings
+// from the environment.
+func newHTTPClient() (*http.Client, error) {
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if err := configureEgress(transport); err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if minVersion := os.Getenv(_tlsMinVersionEnv); minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version %q", minVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if caBundleFile := os.Getenv(_tlsCABundleFileEnv); caBundleFile != "" {
+		caBundle, err := os.ReadFile(caBundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caBundleFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+		fmt.Println("trusting CAs from", caBundleFile)
+	}
+
+	certFile, keyFile := os.Getenv(_tlsClientCertFileEnv), os.Getenv(_tlsClientKeyFileEnv)
+	if certFile != "" || keyFile != "" {
+		clientCertificate := &clientCertificate{certFile: certFile, keyFile: keyFile}
+		if _, err := clientCertificate.get(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return clientCertificate.get()
+		}
+		fmt.Println("presenting client certificate", certFile)
+	}
+
+	if pins := os.Getenv(_tlsPinnedPublicKeysEnv); pins != "" {
+		pinnedPublicKeys, err := parsePublicKeyPins(pins)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPinnedPublicKey(state, pinnedPublicKeys)
+		}
+		fmt.Println(fmt.Sprintf("pinning %d server public keys", len(pinnedPublicKeys)))
+	}
+
+	return tlsConfig, nil
+}
+
+// clientCertificate
+//
+// Loads the client certificate and key, reloading them when either file
+// changes, so a rotated certificate (e.g. an updated Secret volume) is used
+// for new connections without restarting.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func (cc *clientCertificate) get() (*tls.Certificate, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	modTime, err := latestModTime(cc.certFile, cc.keyFile)
+	if err != nil {
+		if cc.certificate != nil {
+			// Keep using the current certificate while the files are being replaced
+			return cc.certificate, nil
+		}
+		return nil, fmt.Errorf("unable to read client certificate: %w", err)
+	}
+	if cc.certificate != nil && modTime.Equal(cc.modTime) {
+		return cc.certificate, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cc.certFile, cc.keyFile)
+	if err != nil {
+		if cc.certificate != nil {
+			fmt.Println("WARN: unable to reload client certificate, using the previous one:", err)
+			return cc.certificate, nil
+		}
+		return nil, fmt.Errorf("unable to load client certificate: %w", err)
+	}
+
+	if cc.certificate != nil {
+		fmt.Println("reloaded client certificate", cc.certFile)
+	}
+	cc.certificate, cc.modTime = &certificate, modTime
+	return cc.certificate, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func parsePublicKeyPins(value string) (map[string]bool, error) {
+	pins := make(map[string]bool)
+	for _, pin := range strings.Split(value, ",") {
+		pin = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+		if pin == "" {
+			continue
+		}
+		if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid public key pin %q, expecting a base64 sha256 hash", pin)
+		}
+		pins[pin] = true
+	}
+	return pins, nil
+}
+
+// verifyPinnedPublicKey
+//
+// Checks that a certificate of the server's verified chain has one of the
+// pinned public keys.
+func verifyPinnedPublicKey(state tls.ConnectionState, pinnedPublicKeys map[string]bool) error {
+	for _, chain := range state.VerifiedChains {
+		for _, certificate := range chain {
+			hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+			if pinnedPublicKeys[base64.StdEncoding.EncodeToString(hash[:])] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no pinned public key in the certificate chain of %s", state.ServerName)
+}
@@ -1,6 +1,7 @@
 package altc
 
 import (
+	"crypto/sha256"
 	"fmt"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -25,12 +26,86 @@ type ClusterObjectItem struct {
 	Action  Action
 	Kind    string
 	Payload ResourceObject
+	// MetadataOnly indicates the payload is a metav1.PartialObjectMetadata
+	// containing only the object's metadata
+	MetadataOnly bool `json:",omitempty"`
+	// Truncated indicates the object was too large to send and the payload
+	// has been reduced to the object's identifying metadata
+	Truncated bool `json:",omitempty"`
+	// Findings of the security posture rules evaluated against the object
+	Findings []*Finding `json:",omitempty"`
+}
+
+// Finding
+//
+// A security posture rule failing for an object (see posture.Rule), e.g. a
+// privileged container.
+type Finding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	// Container the finding applies to, empty if it applies to the object
+	Container string `json:"container,omitempty"`
 }
 
 type SnapshotObject struct {
-	ClusterName string               `json:"clusterName"`
-	SnapshotId  k8stypes.UID         `json:"snapshotId"`
-	Data        []*ClusterObjectItem `json:"data"`
+	ClusterName string       `json:"clusterName"`
+	SnapshotId  k8stypes.UID `json:"snapshotId"`
+	// Kinds whose informer caches had not synced when the snapshot was
+	// collected; the snapshot does not contain objects of these kinds
+	PendingKinds []string `json:"pendingKinds,omitempty"`
+	// Position of the batch within the snapshot, starting at 1
+	Sequence int `json:"sequence,omitempty"`
+	// Deterministic identifier of the batch (see NewBatchId), sent as the
+	// Idempotency-Key so the server can discard batches it has already processed
+	BatchId string               `json:"batchId,omitempty"`
+	Data    []*ClusterObjectItem `json:"data"`
+	// Set on the request sent once all of the snapshot's batches have been
+	// acknowledged, which carries no data
+	Commit *SnapshotCommit `json:"commit,omitempty"`
+	// Identity of the cluster, which, unlike the cluster name, is unique
+	ClusterInfo *ClusterInfo `json:"clusterInfo,omitempty"`
+	// Records derived from the snapshot's objects, sent in batches without data
+	Records []*Record `json:"records,omitempty"`
+}
+
+// ClusterInfo
+//
+// Identifies the cluster a snapshot was collected from and describes it.
+// ClusterId is the uid of the kube-system namespace, stable for the lifetime
+// of the cluster; the other fields are omitted if they can't be determined.
+type ClusterInfo struct {
+	ClusterId     string `json:"clusterId"`
+	ServerVersion string `json:"serverVersion,omitempty"`
+	// Platform the cluster runs on, e.g. "eks", "gke", "aks", "openshift"
+	Platform  string `json:"platform,omitempty"`
+	NodeCount int    `json:"nodeCount"`
+}
+
+// SnapshotCommit
+//
+// Marks a snapshot sent in batches as complete: every batch, up to and
+// including sequence number Batches, has been acknowledged by the server,
+// except for the Replaced batches. Those were split into batches with new
+// sequence numbers after the server rejected them as too large, so they are
+// never acknowledged.
+type SnapshotCommit struct {
+	// Highest sequence number of the snapshot's batches
+	Batches  int   `json:"batches"`
+	Replaced []int `json:"replaced,omitempty"`
+}
+
+// NewSnapshotCommit returns the commit of a snapshot sent in batches up to
+// sequence number 'batches', the 'replaced' batches excepted
+func NewSnapshotCommit(clusterName string, snapshotId k8stypes.UID, pendingKinds []string, batches int, replaced []int) *SnapshotObject {
+	return &SnapshotObject{
+		ClusterName:  clusterName,
+		SnapshotId:   snapshotId,
+		PendingKinds: pendingKinds,
+		BatchId:      fmt.Sprintf("%s-commit", snapshotId),
+		Data:         []*ClusterObjectItem{},
+		Commit:       &SnapshotCommit{Batches: batches, Replaced: replaced},
+	}
 }
 
 func NewClusterObjectItem(action Action, resourceObject ResourceObject) (*ClusterObjectItem, error) {
@@ -51,3 +126,61 @@ func NewClusterObjectItem(action Action, resourceObject ResourceObject) (*Cluste
 		Payload: resourceObject,
 	}, nil
 }
+
+// NewMetadataClusterObjectItem
+//
+// Creates a ClusterObjectItem for an object collected in metadata-only mode.
+// The kind is provided by the caller since metadata objects do not carry
+// the kind of the object they describe.
+func NewMetadataClusterObjectItem(action Action, kind string, objectMetadata *metav1.PartialObjectMetadata) *ClusterObjectItem {
+	return &ClusterObjectItem{
+		Action:       action,
+		Kind:         kind,
+		Payload:      objectMetadata,
+		MetadataOnly: true,
+	}
+}
+
+// Truncate
+//
+// Returns a copy of the item whose payload is reduced to the metadata that
+// identifies the object, for objects too large to be sent in full.
+func (item *ClusterObjectItem) Truncate() *ClusterObjectItem {
+	payload := item.Payload
+	return &ClusterObjectItem{
+		Action: item.Action,
+		Kind:   item.Kind,
+		Payload: &metav1.PartialObjectMetadata{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              payload.GetName(),
+				Namespace:         payload.GetNamespace(),
+				UID:               payload.GetUID(),
+				ResourceVersion:   payload.GetResourceVersion(),
+				Generation:        payload.GetGeneration(),
+				CreationTimestamp: payload.GetCreationTimestamp(),
+				DeletionTimestamp: payload.GetDeletionTimestamp(),
+				Labels:            payload.GetLabels(),
+				OwnerReferences:   payload.GetOwnerReferences(),
+			},
+		},
+		MetadataOnly: true,
+		Truncated:    true,
+		Findings:     item.Findings,
+	}
+}
+
+// NewBatchId
+//
+// Returns a deterministic identifier for a batch of a snapshot: the snapshot
+// id, the batch's sequence number and a hash of the batch's content. The
+// content hash covers the identity and version of each object rather than
+// the encoded batch, so the id doesn't change if the batch is resent with a
+// different encoding or compression.
+func NewBatchId(snapshotId k8stypes.UID, sequence int, items []*ClusterObjectItem) string {
+	hash := sha256.New()
+	for _, item := range items {
+		fmt.Fprintf(hash, "%s/%s/%s/%s/%s/%t\n", item.Kind, item.Payload.GetNamespace(), item.Payload.GetName(),
+			item.Payload.GetUID(), item.Payload.GetResourceVersion(), item.Truncated)
+	}
+	return fmt.Sprintf("%s-%d-%x", snapshotId, sequence, hash.Sum(nil)[:8])
+}
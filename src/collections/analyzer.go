@@ -0,0 +1,65 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Analyzer
+//
+// Derives records from a snapshot's objects (e.g. the relationships between
+// them), which are sent with the snapshot after its objects. An analyzer
+// observes the objects as they are collected, so it should keep only what it
+// needs from them.
+type Analyzer interface {
+	Name() string
+	// Observe is called with each object collected from the informers'
+	// stores: a typed object, or metav1.PartialObjectMetadata for
+	// metadata-only informers
+	Observe(informer *altcinformers.Informer, obj interface{})
+	// Records is called once all of the snapshot's objects have been observed
+	Records(ctx context.Context) []*altc.Record
+}
+
+// AnalyzerFactory returns an analyzer for a snapshot
+type AnalyzerFactory func() Analyzer
+
+// snapshotAnalyzers are the analyzers of a snapshot
+type snapshotAnalyzers []Analyzer
+
+func newSnapshotAnalyzers(factories []AnalyzerFactory) snapshotAnalyzers {
+	analyzers := make(snapshotAnalyzers, 0, len(factories))
+	for _, factory := range factories {
+		analyzers = append(analyzers, factory())
+	}
+	return analyzers
+}
+
+func (sa snapshotAnalyzers) observe(informer *altcinformers.Informer, obj interface{}) {
+	for _, analyzer := range sa {
+		analyzer.Observe(informer, obj)
+	}
+}
+
+func (sa snapshotAnalyzers) records(ctx context.Context) []*altc.Record {
+	records := make([]*altc.Record, 0)
+	for _, analyzer := range sa {
+		analyzerRecords := analyzer.Records(ctx)
+		fmt.Println(fmt.Sprintf("%s analyzer: %d records", analyzer.Name(), len(analyzerRecords)))
+		records = append(records, analyzerRecords...)
+	}
+	return records
+}
+
+// sortedKeys returns the keys of the map in order, so records are deterministic
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
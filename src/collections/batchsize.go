@@ -0,0 +1,191 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	"fmt"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"math"
+	"sort"
+)
+
+// fitItem
+//
+// Returns the item, or its truncated form if the item's encoding exceeds
+// 'maxBytes', along with the number of bytes it adds to a batch encoded with
+// 'encoding' (see altc.EncodedItemSize). Returns a nil item if the item
+// can't be sent within 'maxBytes' even when truncated.
+func fitItem(item *altc.ClusterObjectItem, maxBytes int, encoding altc.Encoding) (*altc.ClusterObjectItem, int) {
+	size, err := altc.EncodedItemSize(item, encoding)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("ERROR: unable to encode %s %s/%s: %s",
+			item.Kind, item.Payload.GetNamespace(), item.Payload.GetName(), err))
+		return nil, 0
+	}
+	if size <= maxBytes {
+		return item, size
+	}
+
+	truncated := item.Truncate()
+	truncatedSize, err := altc.EncodedItemSize(truncated, encoding)
+	if err != nil || truncatedSize > maxBytes {
+		fmt.Println(fmt.Sprintf("ERROR: %s %s/%s (%d bytes) exceeds the batch max bytes (%d) even when truncated, not sending",
+			item.Kind, item.Payload.GetNamespace(), item.Payload.GetName(), size, maxBytes))
+		return nil, 0
+	}
+
+	fmt.Println(fmt.Sprintf("WARN: %s %s/%s (%d bytes) exceeds the batch max bytes (%d), sending truncated to metadata",
+		item.Kind, item.Payload.GetNamespace(), item.Payload.GetName(), size, maxBytes))
+	return truncated, truncatedSize
+}
+
+// batchEnvelopeSize
+//
+// Returns the size of the encoding of a batch of the snapshot without its
+// items, reserved in each batch when batching by size. The batch id and
+// sequence number are sized for the largest sequence number.
+func (so *SnapshotObjects) batchEnvelopeSize(snapshotId k8stypes.UID, pendingKinds []string, encoding altc.Encoding) int {
+	envelope := &altc.SnapshotObject{
+		ClusterName:  so.SnapshotObjectsContext.ClusterName,
+		SnapshotId:   snapshotId,
+		PendingKinds: pendingKinds,
+		Sequence:     math.MaxInt32,
+		BatchId:      altc.NewBatchId(snapshotId, math.MaxInt32, nil),
+		Data:         []*altc.ClusterObjectItem{},
+		ClusterInfo:  so.clusterInfo.Load(),
+	}
+	size, err := altc.EncodedSize(envelope, encoding)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("ERROR: unable to encode the batch envelope: %s", err))
+		return 0
+	}
+	return size
+}
+
+// recordBatchEnvelopeSize
+//
+// Returns the size of the encoding of a batch of the snapshot's records
+// without its records (see batchEnvelopeSize). The envelope's size is that of
+// a batch of a single empty record, less the bytes the record adds to it.
+func (so *SnapshotObjects) recordBatchEnvelopeSize(snapshotId k8stypes.UID, pendingKinds []string, encoding altc.Encoding) int {
+	record := &altc.Record{}
+	envelope := &altc.SnapshotObject{
+		ClusterName:  so.SnapshotObjectsContext.ClusterName,
+		SnapshotId:   snapshotId,
+		PendingKinds: pendingKinds,
+		Sequence:     math.MaxInt32,
+		BatchId:      altc.NewRecordsBatchId(snapshotId, math.MaxInt32, nil),
+		Data:         []*altc.ClusterObjectItem{},
+		ClusterInfo:  so.clusterInfo.Load(),
+		Records:      []*altc.Record{record},
+	}
+	size, err := altc.EncodedSize(envelope, encoding)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("ERROR: unable to encode the records batch envelope: %s", err))
+		return 0
+	}
+	recordSize, err := altc.EncodedRecordSize(record, encoding)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("ERROR: unable to encode the records batch envelope: %s", err))
+		return 0
+	}
+	return size - recordSize
+}
+
+// recordBatches
+//
+// Splits the snapshot's records into batches of at most 'limit' records and,
+// if the batch max bytes is set, at most that many bytes once encoded with
+// the client's encoding, the batch's envelope included. A record too large
+// for a batch on its own is not sent.
+func (so *SnapshotObjects) recordBatches(snapshotId k8stypes.UID, pendingKinds []string, records []*altc.Record, limit int) [][]*altc.Record {
+	batchMaxBytes := so.SnapshotObjectsContext.BatchMaxBytes
+	encoding := so.snapshotEncoding()
+	recordMaxBytes := batchMaxBytes
+	if batchMaxBytes > 0 {
+		recordMaxBytes = batchMaxBytes - so.recordBatchEnvelopeSize(snapshotId, pendingKinds, encoding)
+	}
+
+	batches := make([][]*altc.Record, 0)
+	batch := make([]*altc.Record, 0)
+	batchBytes := 0
+	for _, record := range records {
+		size := 0
+		if batchMaxBytes > 0 {
+			var err error
+			if size, err = altc.EncodedRecordSize(record, encoding); err != nil {
+				fmt.Println(fmt.Sprintf("ERROR: unable to encode %s record: %s", record.Type, err))
+				continue
+			}
+			if size > recordMaxBytes {
+				fmt.Println(fmt.Sprintf("ERROR: %s record (%d bytes) exceeds the batch max bytes (%d), not sending",
+					record.Type, size, batchMaxBytes))
+				continue
+			}
+		}
+
+		// Start the next batch with the record if it doesn't fit in this one
+		if len(batch) >= limit || (batchMaxBytes > 0 && len(batch) > 0 && batchBytes+size > recordMaxBytes) {
+			batches = append(batches, batch)
+			batch = make([]*altc.Record, 0)
+			batchBytes = 0
+		}
+		batch = append(batch, record)
+		batchBytes += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// snapshotEncoding returns the encoding the client sends batches with
+func (so *SnapshotObjects) snapshotEncoding() altc.Encoding {
+	if so.client == nil {
+		return altc.JSONEncoding
+	}
+	return so.client.SnapshotEncoding()
+}
+
+// batchStats
+//
+// Records the sizes of the batches sent for a snapshot, in order to report
+// their distribution once the snapshot has been sent.
+type batchStats struct {
+	items           []int64
+	bytes           []int64
+	compressedBytes []int64
+	// Ratio of uncompressed to compressed size
+	compressionRatios []float64
+}
+
+func (bs *batchStats) record(items int, stats *altc.SendStats) {
+	bs.items = append(bs.items, int64(items))
+	if stats != nil {
+		bs.bytes = append(bs.bytes, stats.Bytes)
+		bs.compressedBytes = append(bs.compressedBytes, stats.CompressedBytes)
+		bs.compressionRatios = append(bs.compressionRatios, stats.CompressionRatio())
+	}
+}
+
+func (bs *batchStats) report(snapshotId k8stypes.UID) {
+	fmt.Println(fmt.Sprintf("snapshot %s sent in %d batches", snapshotId, len(bs.items)))
+	fmt.Println("  items per batch:           ", distribution(bs.items, "%d"))
+	fmt.Println("  bytes per batch:           ", distribution(bs.bytes, "%d"))
+	fmt.Println("  compressed bytes per batch:", distribution(bs.compressedBytes, "%d"))
+	fmt.Println("  compression ratio:         ", distribution(bs.compressionRatios, "%.2f"))
+}
+
+// distribution summarizes the values as min/p50/p90/max
+func distribution[T int64 | float64](values []T, format string) string {
+	if len(values) == 0 {
+		return "n/a"
+	}
+
+	sorted := append([]T(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) T {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	return fmt.Sprintf("min "+format+", p50 "+format+", p90 "+format+", max "+format,
+		sorted[0], percentile(50), percentile(90), sorted[len(sorted)-1])
+}
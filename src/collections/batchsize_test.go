@@ -0,0 +1,275 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testEncodings = []altc.Encoding{altc.JSONEncoding, altc.ProtobufEncoding}
+
+func testItem(t *testing.T, name string, annotationBytes int, labelBytes int) *altc.ClusterObjectItem {
+	t.Helper()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+	if annotationBytes > 0 {
+		pod.Annotations = map[string]string{"annotation": strings.Repeat("a", annotationBytes)}
+	}
+	if labelBytes > 0 {
+		pod.Labels = map[string]string{"label": strings.Repeat("l", labelBytes)}
+	}
+	item, err := altc.NewClusterObjectItem("todo-remove-action-from-schema", pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+// newEncodingSnapshotObjects returns snapshot objects whose client sends batches with the encoding
+func newEncodingSnapshotObjects(t *testing.T, bufferSize int, encoding altc.Encoding, context SnapshotObjectsContext) *SnapshotObjects {
+	t.Helper()
+	t.Setenv("SERVER_ENCODING", string(encoding))
+	so := newTestSnapshotObjects(bufferSize, context)
+	client, err := altc.NewClient(altc.NewSecrets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	so.client = client
+	return so
+}
+
+func TestFitItem(t *testing.T) {
+	for _, encoding := range testEncodings {
+		t.Run(string(encoding), func(t *testing.T) {
+			tests := []struct {
+				name      string
+				item      *altc.ClusterObjectItem
+				fits      bool
+				truncated bool
+			}{
+				{name: "fits", item: testItem(t, "small", 0, 0), fits: true},
+				{name: "truncated", item: testItem(t, "annotated", 2000, 0), fits: true, truncated: true},
+				// Labels are kept when truncating
+				{name: "too large", item: testItem(t, "labelled", 0, 2000)},
+			}
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					item, size := fitItem(test.item, 1000, encoding)
+					if !test.fits {
+						if item != nil {
+							t.Fatalf("item of %d bytes fit in 1000 bytes", size)
+						}
+						return
+					}
+					if item == nil {
+						t.Fatal("item did not fit")
+					}
+					if item.Truncated != test.truncated {
+						t.Errorf("truncated = %t, want %t", item.Truncated, test.truncated)
+					}
+					want, err := altc.EncodedItemSize(item, encoding)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if size != want || size > 1000 {
+						t.Errorf("size = %d, want %d (at most 1000)", size, want)
+					}
+				})
+			}
+		})
+	}
+}
+
+// TestPopulateBatchMaxBytes checks the batches' encodings, envelope included, fit in the batch max bytes
+func TestPopulateBatchMaxBytes(t *testing.T) {
+	const batchMaxBytes = 2000
+	for _, encoding := range testEncodings {
+		t.Run(string(encoding), func(t *testing.T) {
+			so := newEncodingSnapshotObjects(t, 1, encoding, SnapshotObjectsContext{
+				ClusterName:   "cluster",
+				BatchMaxBytes: batchMaxBytes,
+			})
+			objects := make([]interface{}, 0)
+			for i := 0; i < 20; i++ {
+				pod := testItem(t, fmt.Sprintf("pod-%02d", i), i*100, 0).Payload
+				objects = append(objects, pod)
+			}
+			collect(so, newTestInformer("Pods", objects...))
+
+			batches := populateAll(t, so)
+			items := 0
+			truncated := 0
+			for _, batch := range batches {
+				batch.ClusterName = so.SnapshotObjectsContext.ClusterName
+				size, err := altc.EncodedSize(batch, encoding)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if size > batchMaxBytes {
+					t.Errorf("batch %d of %d items is %d bytes, more than %d", batch.Sequence, len(batch.Data), size, batchMaxBytes)
+				}
+				for _, item := range batch.Data {
+					items++
+					if item.Truncated {
+						truncated++
+					}
+				}
+			}
+			if items != 20 {
+				t.Errorf("sent %d items, want 20", items)
+			}
+			if truncated == 0 {
+				t.Error("no item was truncated")
+			}
+		})
+	}
+}
+
+// TestRecordBatchesMaxBytes checks the record batches' encodings, envelope included, fit in the batch max bytes
+func TestRecordBatchesMaxBytes(t *testing.T) {
+	const batchMaxBytes = 2000
+	for _, encoding := range testEncodings {
+		t.Run(string(encoding), func(t *testing.T) {
+			so := newEncodingSnapshotObjects(t, 1, encoding, SnapshotObjectsContext{
+				ClusterName:   "cluster",
+				BatchMaxBytes: batchMaxBytes,
+			})
+			records := make([]*altc.Record, 0)
+			for i := 0; i < 20; i++ {
+				records = append(records, &altc.Record{Type: "test", Data: strings.Repeat("r", i*50)})
+			}
+			// Too large for a batch on its own
+			records = append(records, &altc.Record{Type: "test", Data: strings.Repeat("r", batchMaxBytes)})
+
+			sent := 0
+			batches := so.recordBatches("snapshot", nil, records, 5)
+			for i, batch := range batches {
+				if len(batch) > 5 {
+					t.Errorf("batch %d has %d records, more than 5", i, len(batch))
+				}
+				sent += len(batch)
+				size, err := altc.EncodedSize(&altc.SnapshotObject{
+					ClusterName: so.SnapshotObjectsContext.ClusterName,
+					SnapshotId:  "snapshot",
+					Sequence:    i + 1,
+					BatchId:     altc.NewRecordsBatchId("snapshot", i+1, batch),
+					Data:        []*altc.ClusterObjectItem{},
+					Records:     batch,
+				}, encoding)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if size > batchMaxBytes {
+					t.Errorf("batch %d of %d records is %d bytes, more than %d", i, len(batch), size, batchMaxBytes)
+				}
+			}
+			if sent != 20 {
+				t.Errorf("sent %d records, want 20", sent)
+			}
+			if len(batches) <= 4 {
+				t.Errorf("%d batches, want the records split by size", len(batches))
+			}
+		})
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	records := []*altc.Record{{Type: "a"}, {Type: "b"}, {Type: "c"}}
+	tests := []struct {
+		name  string
+		items []*altc.ClusterObjectItem
+		// Records are split instead of the items if set
+		records []*altc.Record
+		// Sizes of the batches queued in place of the batch, nil if dropped
+		want      []int
+		truncated bool
+	}{
+		{name: "split", items: []*altc.ClusterObjectItem{testItem(t, "a", 0, 0), testItem(t, "b", 0, 0), testItem(t, "c", 0, 0)}, want: []int{1, 2}},
+		{name: "truncate", items: []*altc.ClusterObjectItem{testItem(t, "a", 0, 0)}, want: []int{1}, truncated: true},
+		{name: "drop truncated", items: []*altc.ClusterObjectItem{testItem(t, "a", 0, 0).Truncate()}},
+		{name: "split records", records: records, want: []int{1, 2}},
+		{name: "drop record", records: records[:1]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			so := newTestSnapshotObjects(1, SnapshotObjectsContext{})
+			batches := so.batches.Load()
+			snapshotObject := &altc.SnapshotObject{SnapshotId: "snapshot", Sequence: batches.next(), Data: test.items, Records: test.records}
+
+			so.splitBatch(snapshotObject)
+
+			sizes := make([]int, 0)
+			for so.queue.Len() > 0 {
+				queued, _ := so.getSnapshotObject()
+				so.queue.Done(queued)
+				sizes = append(sizes, len(queued.Data)+len(queued.Records))
+				if test.truncated && !queued.Data[0].Truncated {
+					t.Error("item was not truncated")
+				}
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(append([]int{}, test.want...)) {
+				t.Errorf("queued batches of %v, want %v", sizes, test.want)
+			}
+
+			// The split batch is resolved, replaced or dropped
+			total, _, dropped := batches.counts()
+			if total != 1+len(test.want) {
+				t.Errorf("batches = %d, want %d", total, 1+len(test.want))
+			}
+			if wantDropped := len(test.want) == 0; (dropped == 1) != wantDropped {
+				t.Errorf("dropped = %d, want dropped %t", dropped, wantDropped)
+			}
+			if batches.outstanding[snapshotObject.Sequence] {
+				t.Error("split batch is still outstanding")
+			}
+		})
+	}
+}
+
+func TestCommitSplitBatch(t *testing.T) {
+	var commit *altc.SnapshotCommit
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var snapshotObject altc.SnapshotObject
+		if err := json.NewDecoder(r.Body).Decode(&snapshotObject); err != nil {
+			t.Error(err)
+		}
+		commit = snapshotObject.Commit
+	}))
+	defer server.Close()
+	t.Setenv("SERVER_URL", server.URL)
+	t.Setenv("SERVER_COMPRESSION", "identity")
+	t.Setenv("AUTH_PROVIDER", "api_key")
+	t.Setenv("AUTH_API_KEY", "key")
+
+	so := newEncodingSnapshotObjects(t, 1, altc.JSONEncoding, SnapshotObjectsContext{})
+	batches := so.batches.Load()
+	first := batches.next()
+	split := &altc.SnapshotObject{SnapshotId: "snapshot", Sequence: batches.next(),
+		Data: []*altc.ClusterObjectItem{testItem(t, "a", 0, 0), testItem(t, "b", 0, 0)}}
+	last := batches.next()
+
+	// The halves are queued as batches 4 and 5 in place of batch 2
+	so.splitBatch(split)
+	for _, sequence := range []int{first, last} {
+		batches.acknowledge(sequence, 1, &altc.SendStats{})
+	}
+	for so.queue.Len() > 0 {
+		half, _ := so.getSnapshotObject()
+		so.queue.Done(half)
+		batches.acknowledge(half.Sequence, len(half.Data), &altc.SendStats{})
+	}
+
+	so.commit(context.Background(), batches, nil)
+	if commit == nil {
+		t.Fatal("snapshot not committed")
+	}
+	if commit.Batches != 5 || fmt.Sprint(commit.Replaced) != "[2]" {
+		t.Errorf("commit = %+v, want batches 5, replaced [2]", commit)
+	}
+}
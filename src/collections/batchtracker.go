@@ -0,0 +1,162 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	"context"
+	"fmt"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sort"
+	"sync"
+)
+
+// batchTracker
+//
+// Tracks the batches of a snapshot from when they are queued until they are
+// resolved: acknowledged by the server, dropped, or replaced by the halves of
+// a split batch. Batches are sent concurrently so they may be acknowledged out
+// of order; the tracker reports the sequence number up to which every batch
+// has been resolved.
+type batchTracker struct {
+	snapshotId k8stypes.UID
+
+	mu sync.Mutex
+	// Sequence number of the last batch queued
+	sequence int
+	// Sequence numbers of the batches queued or being sent
+	outstanding map[int]bool
+	// Number of times each outstanding batch has been requeued after failing to send
+	requeues map[int]int
+	// Every batch up to this sequence number has been resolved
+	watermark    int
+	acknowledged int
+	dropped      int
+	// Sequence numbers of the batches replaced by the halves of a split batch
+	replaced []int
+	// Sizes of the acknowledged batches
+	stats batchStats
+	// Closed, and replaced, each time a batch is resolved
+	resolved chan struct{}
+}
+
+func newBatchTracker(snapshotId k8stypes.UID) *batchTracker {
+	return &batchTracker{
+		snapshotId:  snapshotId,
+		outstanding: make(map[int]bool),
+		requeues:    make(map[int]int),
+		resolved:    make(chan struct{}),
+	}
+}
+
+// next returns the sequence number of a new batch, which is outstanding until resolved
+func (bt *batchTracker) next() int {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	bt.sequence++
+	bt.outstanding[bt.sequence] = true
+	return bt.sequence
+}
+
+func (bt *batchTracker) acknowledge(sequence int, items int, stats *altc.SendStats) {
+	bt.resolve(sequence, func() {
+		bt.acknowledged++
+		bt.stats.record(items, stats)
+	})
+}
+
+func (bt *batchTracker) drop(sequence int) {
+	bt.resolve(sequence, func() { bt.dropped++ })
+}
+
+// replace resolves a batch that has been split into other batches
+func (bt *batchTracker) replace(sequence int) {
+	bt.resolve(sequence, func() { bt.replaced = append(bt.replaced, sequence) })
+}
+
+// requeue counts an attempt at requeuing a batch that failed to send,
+// returning false once the batch has been requeued 'limit' times
+func (bt *batchTracker) requeue(sequence int, limit int) bool {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if bt.requeues[sequence] >= limit {
+		return false
+	}
+	bt.requeues[sequence]++
+	return true
+}
+
+func (bt *batchTracker) resolve(sequence int, count func()) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if !bt.outstanding[sequence] {
+		return
+	}
+	delete(bt.outstanding, sequence)
+	delete(bt.requeues, sequence)
+	count()
+
+	watermark := bt.watermark
+	for watermark < bt.sequence && !bt.outstanding[watermark+1] {
+		watermark++
+	}
+	if watermark != bt.watermark {
+		bt.watermark = watermark
+		fmt.Println(fmt.Sprintf("snapshot %s: batches resolved through sequence %d", bt.snapshotId, watermark))
+	}
+
+	close(bt.resolved)
+	bt.resolved = make(chan struct{})
+}
+
+// waitForCapacity blocks until fewer than 'limit' batches are outstanding.
+// Returns false if the context is done.
+func (bt *batchTracker) waitForCapacity(ctx context.Context, limit int) bool {
+	return bt.wait(ctx, func() bool { return len(bt.outstanding) < limit })
+}
+
+// waitForAll blocks until every batch has been resolved. Returns false if the context is done.
+func (bt *batchTracker) waitForAll(ctx context.Context) bool {
+	return bt.wait(ctx, func() bool { return len(bt.outstanding) == 0 })
+}
+
+func (bt *batchTracker) wait(ctx context.Context, done func() bool) bool {
+	for {
+		bt.mu.Lock()
+		if done() {
+			bt.mu.Unlock()
+			return true
+		}
+		resolved := bt.resolved
+		bt.mu.Unlock()
+
+		select {
+		case <-resolved:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (bt *batchTracker) report() {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.stats.report(bt.snapshotId)
+}
+
+// replacedSequences returns the sequence numbers of the batches replaced by other batches, in order
+func (bt *batchTracker) replacedSequences() []int {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	replaced := append([]int{}, bt.replaced...)
+	sort.Ints(replaced)
+	return replaced
+}
+
+// counts returns the number of batches queued, acknowledged and dropped
+func (bt *batchTracker) counts() (batches int, acknowledged int, dropped int) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return bt.sequence, bt.acknowledged, bt.dropped
+}
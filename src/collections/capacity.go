@@ -0,0 +1,177 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const CapacityAnalyzerName = "capacity"
+
+// capacityAnalyzer
+//
+// Summarizes, per node and per namespace, the resources allocated to Pods
+// (the sum of their requests and limits) and, per node, its capacity, taints
+// and conditions, so the capacity of the cluster can be shown without
+// processing every Pod. Sends a nodeCapacity record per node and a
+// namespaceAllocation record per namespace with Pods. Pods that have
+// completed don't hold resources and are not counted.
+type capacityAnalyzer struct {
+	nodes map[string]*altc.NodeCapacity
+	// Resources allocated on each node, by node name, and to each namespace
+	nodeAllocations      map[string]*allocation
+	namespaceAllocations map[string]*allocation
+}
+
+type allocation struct {
+	requested altc.ResourceAmounts
+	limits    altc.ResourceAmounts
+	pods      int
+}
+
+func NewCapacityAnalyzer() Analyzer {
+	return &capacityAnalyzer{
+		nodes:                make(map[string]*altc.NodeCapacity),
+		nodeAllocations:      make(map[string]*allocation),
+		namespaceAllocations: make(map[string]*allocation),
+	}
+}
+
+func (ca *capacityAnalyzer) Name() string {
+	return CapacityAnalyzerName
+}
+
+func (ca *capacityAnalyzer) Observe(informer *altcinformers.Informer, obj interface{}) {
+	switch o := obj.(type) {
+	case *corev1.Node:
+		ca.observeNode(objectRef(informer, obj, o), o)
+	case *corev1.Pod:
+		if podCompleted(o) {
+			return
+		}
+		requested, limits := podResources(o)
+		if o.Spec.NodeName != "" {
+			allocationOf(ca.nodeAllocations, o.Spec.NodeName).add(requested, limits)
+		}
+		allocationOf(ca.namespaceAllocations, o.Namespace).add(requested, limits)
+	}
+}
+
+func (ca *capacityAnalyzer) observeNode(ref altc.ObjectRef, node *corev1.Node) {
+	nodeCapacity := &altc.NodeCapacity{
+		Node:          ref,
+		Capacity:      resourceAmounts(node.Status.Capacity),
+		Allocatable:   resourceAmounts(node.Status.Allocatable),
+		MaxPods:       node.Status.Allocatable.Pods().Value(),
+		Unschedulable: node.Spec.Unschedulable,
+		Conditions:    make(map[string]string, len(node.Status.Conditions)),
+	}
+	for _, taint := range node.Spec.Taints {
+		nodeCapacity.Taints = append(nodeCapacity.Taints, taint.ToString())
+	}
+	for _, condition := range node.Status.Conditions {
+		nodeCapacity.Conditions[string(condition.Type)] = string(condition.Status)
+	}
+	ca.nodes[node.Name] = nodeCapacity
+}
+
+func (ca *capacityAnalyzer) Records(context.Context) []*altc.Record {
+	records := make([]*altc.Record, 0, len(ca.nodes)+len(ca.namespaceAllocations))
+
+	for _, name := range sortedKeys(ca.nodes) {
+		nodeCapacity := ca.nodes[name]
+		if nodeAllocation, ok := ca.nodeAllocations[name]; ok {
+			nodeCapacity.Requested = nodeAllocation.requested
+			nodeCapacity.Limits = nodeAllocation.limits
+			nodeCapacity.Pods = nodeAllocation.pods
+		}
+		records = append(records, &altc.Record{Type: altc.NodeCapacityRecordType, Data: nodeCapacity})
+	}
+	for name := range ca.nodeAllocations {
+		if _, ok := ca.nodes[name]; !ok {
+			fmt.Println(fmt.Sprintf("WARN: Pods are scheduled on node %s, which was not collected", name))
+		}
+	}
+
+	for _, namespace := range sortedKeys(ca.namespaceAllocations) {
+		namespaceAllocation := ca.namespaceAllocations[namespace]
+		records = append(records, &altc.Record{Type: altc.NamespaceAllocationRecordType, Data: &altc.NamespaceAllocation{
+			Namespace: namespace,
+			Requested: namespaceAllocation.requested,
+			Limits:    namespaceAllocation.limits,
+			Pods:      namespaceAllocation.pods,
+		}})
+	}
+	return records
+}
+
+func allocationOf(allocations map[string]*allocation, key string) *allocation {
+	a, ok := allocations[key]
+	if !ok {
+		a = &allocation{}
+		allocations[key] = a
+	}
+	return a
+}
+
+func (a *allocation) add(requested altc.ResourceAmounts, limits altc.ResourceAmounts) {
+	a.requested = addResourceAmounts(a.requested, requested)
+	a.limits = addResourceAmounts(a.limits, limits)
+	a.pods++
+}
+
+// podCompleted returns whether the Pod has completed, releasing its resources
+func podCompleted(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// podResources
+//
+// Returns the resources the Pod requests and its limits, computed the way
+// the scheduler does: the larger of the sum of the containers' and the
+// largest init container's, plus the Pod's overhead.
+func podResources(pod *corev1.Pod) (requested altc.ResourceAmounts, limits altc.ResourceAmounts) {
+	for _, container := range pod.Spec.Containers {
+		requested = addResourceAmounts(requested, resourceAmounts(container.Resources.Requests))
+		limits = addResourceAmounts(limits, resourceAmounts(container.Resources.Limits))
+	}
+	for _, container := range pod.Spec.InitContainers {
+		requested = maxResourceAmounts(requested, resourceAmounts(container.Resources.Requests))
+		limits = maxResourceAmounts(limits, resourceAmounts(container.Resources.Limits))
+	}
+	overhead := resourceAmounts(pod.Spec.Overhead)
+	return addResourceAmounts(requested, overhead), addResourceAmounts(limits, overhead)
+}
+
+func resourceAmounts(resources corev1.ResourceList) altc.ResourceAmounts {
+	return altc.ResourceAmounts{
+		CPUMillicores:         resources.Cpu().MilliValue(),
+		MemoryBytes:           resources.Memory().Value(),
+		EphemeralStorageBytes: resources.StorageEphemeral().Value(),
+	}
+}
+
+func addResourceAmounts(a altc.ResourceAmounts, b altc.ResourceAmounts) altc.ResourceAmounts {
+	return altc.ResourceAmounts{
+		CPUMillicores:         a.CPUMillicores + b.CPUMillicores,
+		MemoryBytes:           a.MemoryBytes + b.MemoryBytes,
+		EphemeralStorageBytes: a.EphemeralStorageBytes + b.EphemeralStorageBytes,
+	}
+}
+
+func maxResourceAmounts(a altc.ResourceAmounts, b altc.ResourceAmounts) altc.ResourceAmounts {
+	return altc.ResourceAmounts{
+		CPUMillicores:         max64(a.CPUMillicores, b.CPUMillicores),
+		MemoryBytes:           max64(a.MemoryBytes, b.MemoryBytes),
+		EphemeralStorageBytes: max64(a.EphemeralStorageBytes, b.EphemeralStorageBytes),
+	}
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
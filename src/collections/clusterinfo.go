@@ -0,0 +1,195 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+)
+
+const _nodesInformerName = "Nodes"
+
+// Platform hints: node labels, API groups and server version suffixes set by
+// managed Kubernetes offerings and distributions, in order of precedence
+var (
+	platformApiGroups = []struct{ group, platform string }{
+		{"config.openshift.io", "openshift"},
+		{"route.openshift.io", "openshift"},
+	}
+	platformNodeLabels = []struct{ label, platform string }{
+		{"eks.amazonaws.com/nodegroup", "eks"},
+		{"eks.amazonaws.com/compute-type", "eks"},
+		{"cloud.google.com/gke-nodepool", "gke"},
+		{"kubernetes.azure.com/cluster", "aks"},
+		{"kubernetes.azure.com/agentpool", "aks"},
+		{"node.openshift.io/os_id", "openshift"},
+		{"minikube.k8s.io/name", "minikube"},
+	}
+	platformVersions = []struct{ suffix, platform string }{
+		{"-eks-", "eks"},
+		{"-gke.", "gke"},
+		{"+k3s", "k3s"},
+		{"+rke2", "rke2"},
+	}
+	platformProviderIds = []struct{ prefix, platform string }{
+		{"kind://", "kind"},
+		{"aws://", "aws"},
+		{"gce://", "gce"},
+		{"azure://", "azure"},
+	}
+)
+
+// ClusterIdentity
+//
+// Describes the cluster in each snapshot: a stable cluster id (the uid of the
+// kube-system namespace, which, unlike the configured cluster name, is unique
+// to the cluster), the server version, the platform the cluster runs on and
+// its number of nodes. The cluster id, server version and platform don't
+// change during the agent's lifetime, so they are only read once.
+type ClusterIdentity struct {
+	clientset kubernetes.Interface
+	// Nil if nodes are not collected
+	nodes *altcinformers.Informer
+	// Empty until read
+	clusterId     string
+	serverVersion string
+	// Nil until detected from all of the hints
+	platform *string
+}
+
+func NewClusterIdentity(clientset kubernetes.Interface, informers []*altcinformers.Informer) *ClusterIdentity {
+	ci := &ClusterIdentity{clientset: clientset}
+	for _, informer := range informers {
+		if informer.Name == _nodesInformerName {
+			ci.nodes = informer
+		}
+	}
+	return ci
+}
+
+// ClusterInfo
+//
+// Returns the cluster's identity. Information that can't be read is omitted
+// rather than failing the snapshot, and read again for the next snapshot.
+func (ci *ClusterIdentity) ClusterInfo(ctx context.Context) *altc.ClusterInfo {
+	clusterInfo := &altc.ClusterInfo{ClusterId: ci.getClusterId(ctx), ServerVersion: ci.getServerVersion()}
+
+	nodes, listed := ci.listNodes(ctx)
+	clusterInfo.NodeCount = len(nodes)
+	clusterInfo.Platform = ci.getPlatform(nodes, listed)
+	return clusterInfo
+}
+
+func (ci *ClusterIdentity) getClusterId(ctx context.Context) string {
+	if ci.clusterId != "" {
+		return ci.clusterId
+	}
+
+	namespace, err := ci.clientset.CoreV1().Namespaces().Get(ctx, metav1.NamespaceSystem, metav1.GetOptions{})
+	if err != nil {
+		fmt.Println("WARN: unable to read the cluster id:", err)
+		return ""
+	}
+	ci.clusterId = string(namespace.UID)
+	return ci.clusterId
+}
+
+func (ci *ClusterIdentity) getServerVersion() string {
+	if ci.serverVersion != "" {
+		return ci.serverVersion
+	}
+
+	version, err := ci.clientset.Discovery().ServerVersion()
+	if err != nil {
+		fmt.Println("WARN: unable to read the server version:", err)
+		return ""
+	}
+	ci.serverVersion = version.GitVersion
+	return ci.serverVersion
+}
+
+// getPlatform returns the platform, detecting it until it could be with all
+// of the hints: the API groups, the server version and the listed nodes
+func (ci *ClusterIdentity) getPlatform(nodes []interface{}, listed bool) string {
+	if ci.platform != nil {
+		return *ci.platform
+	}
+
+	groups, err := ci.clientset.Discovery().ServerGroups()
+	if err != nil {
+		fmt.Println("WARN: unable to read the API groups:", err)
+	}
+	platform := detectPlatform(groups, ci.serverVersion, nodes)
+	if err == nil && ci.serverVersion != "" && listed {
+		ci.platform = &platform
+	}
+	return platform
+}
+
+// listNodes
+//
+// Returns the nodes from the nodes informer's cache, if synced, otherwise
+// from the API server's cache, and whether they could be listed.
+func (ci *ClusterIdentity) listNodes(ctx context.Context) ([]interface{}, bool) {
+	if ci.nodes != nil && ci.nodes.HasSynced() {
+		return ci.nodes.Informer.GetStore().List(), true
+	}
+
+	nodeList, err := ci.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{ResourceVersion: "0"})
+	if err != nil {
+		fmt.Println("WARN: unable to list nodes:", err)
+		return nil, false
+	}
+	nodes := make([]interface{}, 0, len(nodeList.Items))
+	for i := range nodeList.Items {
+		nodes = append(nodes, &nodeList.Items[i])
+	}
+	return nodes, true
+}
+
+// detectPlatform
+//
+// Infers the platform from the API groups served, the server version and
+// the nodes' labels and provider ids. Empty if there are no hints.
+func detectPlatform(groups *metav1.APIGroupList, gitVersion string, nodes []interface{}) string {
+	if groups != nil {
+		for _, hint := range platformApiGroups {
+			for _, group := range groups.Groups {
+				if group.Name == hint.group {
+					return hint.platform
+				}
+			}
+		}
+	}
+
+	for _, hint := range platformVersions {
+		if strings.Contains(gitVersion, hint.suffix) {
+			return hint.platform
+		}
+	}
+
+	for _, hint := range platformNodeLabels {
+		for _, node := range nodes {
+			if accessor, err := meta.Accessor(node); err == nil {
+				if _, ok := accessor.GetLabels()[hint.label]; ok {
+					return hint.platform
+				}
+			}
+		}
+	}
+
+	// Provider ids are only available with the full node objects
+	for _, hint := range platformProviderIds {
+		for _, node := range nodes {
+			if node, ok := node.(*corev1.Node); ok && strings.HasPrefix(node.Spec.ProviderID, hint.prefix) {
+				return hint.platform
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package collections
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestClusterInfo(t *testing.T) {
+	kubeSystem := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: metav1.NamespaceSystem, UID: "cluster-uid"}}
+	node := func(name string, labels map[string]string, providerId string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Spec:       corev1.NodeSpec{ProviderID: providerId},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		gitVersion string
+		// Group versions served besides the core API
+		groupVersions []string
+		nodes         []runtime.Object
+		want          string
+	}{
+		{name: "no hints", gitVersion: "v1.27.3", nodes: []runtime.Object{node("node-1", nil, "")}},
+		{name: "API group", gitVersion: "v1.27.3", groupVersions: []string{"route.openshift.io/v1"}, want: "openshift"},
+		{name: "server version", gitVersion: "v1.27.4-eks-2d98532", want: "eks"},
+		{
+			name:       "node label",
+			gitVersion: "v1.27.3",
+			nodes:      []runtime.Object{node("node-1", nil, ""), node("node-2", map[string]string{"cloud.google.com/gke-nodepool": "pool"}, "")},
+			want:       "gke",
+		},
+		{name: "provider id", gitVersion: "v1.27.3", nodes: []runtime.Object{node("node-1", nil, "kind://docker/kind/kind-control-plane")}, want: "kind"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(append([]runtime.Object{kubeSystem}, test.nodes...)...)
+			discovery := clientset.Discovery().(*fakediscovery.FakeDiscovery)
+			discovery.FakedServerVersion = &version.Info{GitVersion: test.gitVersion}
+			for _, groupVersion := range test.groupVersions {
+				discovery.Resources = append(discovery.Resources, &metav1.APIResourceList{GroupVersion: groupVersion})
+			}
+
+			identity := NewClusterIdentity(clientset, nil)
+			clusterInfo := identity.ClusterInfo(context.Background())
+			if clusterInfo.ClusterId != "cluster-uid" {
+				t.Errorf("cluster id = %q, want cluster-uid", clusterInfo.ClusterId)
+			}
+			if clusterInfo.ServerVersion != test.gitVersion {
+				t.Errorf("server version = %q, want %q", clusterInfo.ServerVersion, test.gitVersion)
+			}
+			if clusterInfo.NodeCount != len(test.nodes) {
+				t.Errorf("node count = %d, want %d", clusterInfo.NodeCount, len(test.nodes))
+			}
+			if clusterInfo.Platform != test.want {
+				t.Errorf("platform = %q, want %q", clusterInfo.Platform, test.want)
+			}
+
+			// The cluster id, server version and platform are only read once,
+			// the nodes are listed for each snapshot
+			clientset.ClearActions()
+			if again := identity.ClusterInfo(context.Background()); *again != *clusterInfo {
+				t.Errorf("cluster info = %+v, want %+v", again, clusterInfo)
+			}
+			for _, action := range clientset.Actions() {
+				if action.GetResource().Resource != "nodes" {
+					t.Errorf("%s %s on the next snapshot, want only the nodes listed", action.GetVerb(), action.GetResource().Resource)
+				}
+			}
+		})
+	}
+}
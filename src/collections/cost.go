@@ -0,0 +1,245 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"math"
+)
+
+const (
+	CostAnalyzerName = "cost"
+
+	// AnyInstanceType prices the nodes whose instance type has no price of its own
+	AnyInstanceType = "*"
+
+	// Share of a node's price attributed to its CPU, the rest is attributed to its memory
+	_cpuCostWeight = 0.5
+)
+
+// CostModel configures the cost analyzer
+type CostModel struct {
+	// Hourly prices of the nodes by instance type (the
+	// node.kubernetes.io/instance-type label), AnyInstanceType for the others
+	NodePrices map[string]float64
+	// Labels of the Pods to roll their costs up by, e.g. "team"
+	Labels []string
+}
+
+// costAnalyzer
+//
+// Estimates the hourly cost of the cluster's workloads from the prices of
+// its nodes. A node's price is apportioned to the Pods running on it in
+// proportion to the share of its allocatable CPU and memory they request;
+// the rest is the node's idle cost. Sends a nodeCost record per node,
+// costAllocation records rolling the Pods' costs up per namespace, workload
+// and value of each of the model's labels, and a clusterCost record. Pods
+// that have completed, or are not scheduled, don't cost anything.
+type costAnalyzer struct {
+	model     CostModel
+	nodes     map[string]*costNode
+	pods      []costPod
+	workloads workloadControllers
+}
+
+type costNode struct {
+	ref          altc.ObjectRef
+	instanceType string
+	allocatable  altc.ResourceAmounts
+}
+
+type costPod struct {
+	namespace string
+	node      string
+	workload  altc.ObjectRef
+	// Values of the model's labels
+	labels    map[string]string
+	requested altc.ResourceAmounts
+}
+
+// NewCostAnalyzerFactory returns the factory of cost analyzers using the model
+func NewCostAnalyzerFactory(model CostModel) AnalyzerFactory {
+	return func() Analyzer {
+		return &costAnalyzer{
+			model:     model,
+			nodes:     make(map[string]*costNode),
+			workloads: make(workloadControllers),
+		}
+	}
+}
+
+func (ca *costAnalyzer) Name() string {
+	return CostAnalyzerName
+}
+
+func (ca *costAnalyzer) Observe(informer *altcinformers.Informer, obj interface{}) {
+	switch o := obj.(type) {
+	case *corev1.Node:
+		instanceType, ok := o.Labels[corev1.LabelInstanceTypeStable]
+		if !ok {
+			instanceType = o.Labels[corev1.LabelInstanceType]
+		}
+		ca.nodes[o.Name] = &costNode{
+			ref:          objectRef(informer, obj, o),
+			instanceType: instanceType,
+			allocatable:  resourceAmounts(o.Status.Allocatable),
+		}
+	case *corev1.Pod:
+		if podCompleted(o) || o.Spec.NodeName == "" {
+			return
+		}
+		pod := costPod{
+			namespace: o.Namespace,
+			node:      o.Spec.NodeName,
+			workload:  controllerRef(objectRef(informer, obj, o), o),
+			labels:    make(map[string]string),
+		}
+		for _, label := range ca.model.Labels {
+			if value, ok := o.Labels[label]; ok {
+				pod.labels[label] = value
+			}
+		}
+		pod.requested, _ = podResources(o)
+		ca.pods = append(ca.pods, pod)
+	case *appsv1.ReplicaSet:
+		ca.workloads.observe(objectRef(informer, obj, o), o)
+	case *batchv1.Job:
+		ca.workloads.observe(objectRef(informer, obj, o), o)
+	}
+}
+
+func (ca *costAnalyzer) Records(context.Context) []*altc.Record {
+	nodePods := make(map[string][]int)
+	for i, pod := range ca.pods {
+		nodePods[pod.node] = append(nodePods[pod.node], i)
+	}
+
+	podCosts := make([]float64, len(ca.pods))
+	cluster := &altc.ClusterCost{}
+	records := make([]*altc.Record, 0, len(ca.nodes))
+	for _, name := range sortedKeys(ca.nodes) {
+		node := ca.nodes[name]
+		nodeCost := &altc.NodeCost{Node: node.ref, InstanceType: node.instanceType}
+		price, ok := ca.model.NodePrices[node.instanceType]
+		if !ok {
+			price, ok = ca.model.NodePrices[AnyInstanceType]
+		}
+		if !ok {
+			nodeCost.Unpriced = true
+			cluster.UnpricedNodes = append(cluster.UnpricedNodes, name)
+			records = append(records, &altc.Record{Type: altc.NodeCostRecordType, Data: nodeCost})
+			continue
+		}
+
+		// Pods can't request more than the node's allocatable resources, but
+		// the shares are scaled down if they do (e.g. static Pods)
+		shares := make([]float64, len(nodePods[name]))
+		total := 0.0
+		for i, pod := range nodePods[name] {
+			shares[i] = requestShare(ca.pods[pod].requested, node.allocatable)
+			total += shares[i]
+		}
+		scale := 1.0
+		if total > 1 {
+			scale = 1 / total
+		}
+		for i, pod := range nodePods[name] {
+			podCosts[pod] = price * shares[i] * scale
+			nodeCost.Allocated += podCosts[pod]
+		}
+
+		nodeCost.HourlyPrice = price
+		nodeCost.Idle = roundCost(math.Max(price-nodeCost.Allocated, 0))
+		cluster.HourlyPrice += price
+		cluster.Allocated += nodeCost.Allocated
+		cluster.Idle += nodeCost.Idle
+		nodeCost.Allocated = roundCost(nodeCost.Allocated)
+		records = append(records, &altc.Record{Type: altc.NodeCostRecordType, Data: nodeCost})
+	}
+	for name := range nodePods {
+		if _, ok := ca.nodes[name]; !ok {
+			fmt.Println(fmt.Sprintf("WARN: Pods are scheduled on node %s, which was not collected", name))
+		}
+	}
+
+	namespaces := make(map[string]*altc.CostAllocation)
+	workloads := make(map[string]*altc.CostAllocation)
+	labels := make(map[string]*altc.CostAllocation)
+	for i, pod := range ca.pods {
+		addCost(allocationFor(namespaces, pod.namespace, func() *altc.CostAllocation {
+			return &altc.CostAllocation{GroupBy: altc.NamespaceCostGroup, Namespace: pod.namespace}
+		}), podCosts[i], pod.requested)
+
+		workload := ca.workloads.resolve(pod.workload)
+		addCost(allocationFor(workloads, workload.Kind+"/"+workload.Namespace+"/"+workload.Name, func() *altc.CostAllocation {
+			return &altc.CostAllocation{GroupBy: altc.WorkloadCostGroup, Namespace: workload.Namespace, Workload: &workload}
+		}), podCosts[i], pod.requested)
+
+		for label, value := range pod.labels {
+			addCost(allocationFor(labels, label+"="+value, func() *altc.CostAllocation {
+				return &altc.CostAllocation{GroupBy: altc.LabelCostGroup, Label: label, Value: value}
+			}), podCosts[i], pod.requested)
+		}
+	}
+	for _, group := range []map[string]*altc.CostAllocation{namespaces, workloads, labels} {
+		for _, key := range sortedKeys(group) {
+			allocation := group[key]
+			allocation.Cost = roundCost(allocation.Cost)
+			records = append(records, &altc.Record{Type: altc.CostAllocationRecordType, Data: allocation})
+		}
+	}
+
+	cluster.HourlyPrice = roundCost(cluster.HourlyPrice)
+	cluster.Allocated = roundCost(cluster.Allocated)
+	cluster.Idle = roundCost(cluster.Idle)
+	return append(records, &altc.Record{Type: altc.ClusterCostRecordType, Data: cluster})
+}
+
+// requestShare
+//
+// Returns the share of a node's price attributed to the resources requested
+// from it: the weighted shares of its allocatable CPU and memory requested.
+func requestShare(requested altc.ResourceAmounts, allocatable altc.ResourceAmounts) float64 {
+	cpu, hasCPU := resourceShare(requested.CPUMillicores, allocatable.CPUMillicores)
+	memory, hasMemory := resourceShare(requested.MemoryBytes, allocatable.MemoryBytes)
+	switch {
+	case hasCPU && hasMemory:
+		return _cpuCostWeight*cpu + (1-_cpuCostWeight)*memory
+	case hasCPU:
+		return cpu
+	default:
+		return memory
+	}
+}
+
+// resourceShare returns the share of the allocatable amount requested, and whether any is allocatable
+func resourceShare(requested int64, allocatable int64) (float64, bool) {
+	if allocatable <= 0 {
+		return 0, false
+	}
+	return math.Min(float64(requested)/float64(allocatable), 1), true
+}
+
+func allocationFor(allocations map[string]*altc.CostAllocation, key string, newAllocation func() *altc.CostAllocation) *altc.CostAllocation {
+	allocation, ok := allocations[key]
+	if !ok {
+		allocation = newAllocation()
+		allocations[key] = allocation
+	}
+	return allocation
+}
+
+func addCost(allocation *altc.CostAllocation, cost float64, requested altc.ResourceAmounts) {
+	allocation.Cost += cost
+	allocation.Requested = addResourceAmounts(allocation.Requested, requested)
+	allocation.Pods++
+}
+
+// roundCost rounds a cost to a millionth, prices being in units of currency per hour
+func roundCost(cost float64) float64 {
+	return math.Round(cost*1e6) / 1e6
+}
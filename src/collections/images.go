@@ -0,0 +1,246 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sort"
+	"strings"
+)
+
+const (
+	ImagesAnalyzerName = "images"
+
+	_defaultRegistry = "docker.io"
+)
+
+// imagesAnalyzer
+//
+// Builds the inventory of the images referenced by the cluster's running
+// Pods and workload templates, sent as an image record per normalized image
+// reference. Pods are attributed to the workload controlling them, through
+// their ReplicaSet or Job, once all of the snapshot's objects have been
+// observed. The digests are those the container runtime reports in the
+// Pods' container statuses.
+type imagesAnalyzer struct {
+	images    map[string]*imageUsage
+	workloads workloadControllers
+}
+
+// imageUsage accumulates the uses of an image
+type imageUsage struct {
+	image          altc.Image
+	digests        map[string]bool
+	containerTypes map[string]bool
+	namespaces     map[string]bool
+	// Pods or workloads referencing the image, resolved to their controlling
+	// workload once all of the objects have been observed
+	workloads map[altc.ObjectRef]bool
+}
+
+func NewImagesAnalyzer() Analyzer {
+	return &imagesAnalyzer{
+		images:    make(map[string]*imageUsage),
+		workloads: make(workloadControllers),
+	}
+}
+
+func (ia *imagesAnalyzer) Name() string {
+	return ImagesAnalyzerName
+}
+
+func (ia *imagesAnalyzer) Observe(informer *altcinformers.Informer, obj interface{}) {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		ia.observePod(objectRef(informer, obj, o), o)
+	case *appsv1.Deployment:
+		ia.observeTemplate(objectRef(informer, obj, o), &o.Spec.Template)
+	case *appsv1.DaemonSet:
+		ia.observeTemplate(objectRef(informer, obj, o), &o.Spec.Template)
+	case *appsv1.StatefulSet:
+		ia.observeTemplate(objectRef(informer, obj, o), &o.Spec.Template)
+	case *appsv1.ReplicaSet:
+		ref := objectRef(informer, obj, o)
+		ia.workloads.observe(ref, o)
+		// Deployments keep their old ReplicaSets, scaled down, as their revision history
+		if !replicaSetScaledDown(o) {
+			ia.observeTemplate(ref, &o.Spec.Template)
+		}
+	case *corev1.ReplicationController:
+		if o.Spec.Template != nil {
+			ia.observeTemplate(objectRef(informer, obj, o), o.Spec.Template)
+		}
+	case *batchv1.Job:
+		ref := objectRef(informer, obj, o)
+		ia.workloads.observe(ref, o)
+		ia.observeTemplate(ref, &o.Spec.Template)
+	case *batchv1.CronJob:
+		ia.observeTemplate(objectRef(informer, obj, o), &o.Spec.JobTemplate.Spec.Template)
+	}
+}
+
+// replicaSetScaledDown returns true if the ReplicaSet neither wants nor runs any Pods
+func replicaSetScaledDown(replicaSet *appsv1.ReplicaSet) bool {
+	return replicaSet.Spec.Replicas != nil && *replicaSet.Spec.Replicas == 0 && replicaSet.Status.Replicas == 0
+}
+
+func (ia *imagesAnalyzer) observePod(ref altc.ObjectRef, pod *corev1.Pod) {
+	// Completed Pods no longer run their images, those of a Job's Pods are
+	// still referenced by its template
+	if podCompleted(pod) {
+		return
+	}
+	workload := controllerRef(ref, pod)
+
+	// The digests of the images the containers are running, by container name
+	digests := make(map[string]string)
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses,
+		pod.Status.ContainerStatuses, pod.Status.EphemeralContainerStatuses} {
+		for _, status := range statuses {
+			if _, digest, found := strings.Cut(status.ImageID, "@"); found {
+				digests[status.Name] = digest
+			}
+		}
+	}
+
+	podImages := make(map[*imageUsage]bool)
+	use := func(name string, image string, containerType string) {
+		usage := ia.use(image, containerType, pod.Namespace, workload)
+		if usage == nil {
+			return
+		}
+		if digest, ok := digests[name]; ok {
+			usage.digests[digest] = true
+		}
+		podImages[usage] = true
+	}
+	for _, container := range pod.Spec.InitContainers {
+		use(container.Name, container.Image, altc.InitContainerType)
+	}
+	for _, container := range pod.Spec.Containers {
+		use(container.Name, container.Image, altc.RegularContainerType)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		use(container.Name, container.Image, altc.EphemeralContainerType)
+	}
+
+	for usage := range podImages {
+		usage.image.Pods++
+	}
+}
+
+func (ia *imagesAnalyzer) observeTemplate(workload altc.ObjectRef, template *corev1.PodTemplateSpec) {
+	for _, container := range template.Spec.InitContainers {
+		ia.use(container.Image, altc.InitContainerType, workload.Namespace, workload)
+	}
+	for _, container := range template.Spec.Containers {
+		ia.use(container.Image, altc.RegularContainerType, workload.Namespace, workload)
+	}
+}
+
+// use records a use of the image; nil if the container has no image
+func (ia *imagesAnalyzer) use(image string, containerType string, namespace string, workload altc.ObjectRef) *imageUsage {
+	if image == "" {
+		return nil
+	}
+	reference := parseImageReference(image)
+	usage, ok := ia.images[reference.Image]
+	if !ok {
+		usage = &imageUsage{
+			image:          reference,
+			digests:        make(map[string]bool),
+			containerTypes: make(map[string]bool),
+			namespaces:     make(map[string]bool),
+			workloads:      make(map[altc.ObjectRef]bool),
+		}
+		ia.images[reference.Image] = usage
+	}
+	usage.containerTypes[containerType] = true
+	usage.namespaces[namespace] = true
+	usage.workloads[workload] = true
+	return usage
+}
+
+func (ia *imagesAnalyzer) Records(context.Context) []*altc.Record {
+	references := make([]string, 0, len(ia.images))
+	for reference := range ia.images {
+		references = append(references, reference)
+	}
+	sort.Strings(references)
+
+	records := make([]*altc.Record, 0, len(references))
+	for _, reference := range references {
+		usage := ia.images[reference]
+		image := usage.image
+		image.Digests = sortedKeys(usage.digests)
+		image.ContainerTypes = sortedKeys(usage.containerTypes)
+		image.Namespaces = sortedKeys(usage.namespaces)
+
+		workloads := make(map[altc.ObjectRef]bool)
+		for workload := range usage.workloads {
+			workloads[ia.workloads.resolve(workload)] = true
+		}
+		image.Workloads = make([]altc.ObjectRef, 0, len(workloads))
+		for workload := range workloads {
+			image.Workloads = append(image.Workloads, workload)
+		}
+		sort.Slice(image.Workloads, func(i, j int) bool {
+			a, b := image.Workloads[i], image.Workloads[j]
+			if a.Kind != b.Kind {
+				return a.Kind < b.Kind
+			}
+			if a.Namespace != b.Namespace {
+				return a.Namespace < b.Namespace
+			}
+			return a.Name < b.Name
+		})
+
+		records = append(records, &altc.Record{Type: altc.ImageRecordType, Data: &image})
+	}
+	return records
+}
+
+// parseImageReference
+//
+// Splits an image reference into its registry, repository, tag and digest,
+// normalized the way container runtimes resolve them: the registry defaults
+// to docker.io, where single component repositories are in 'library', and
+// the tag defaults to 'latest' unless the image is pinned by digest.
+func parseImageReference(image string) altc.Image {
+	var reference altc.Image
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, reference.Digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, reference.Tag = name[:i], name[i+1:]
+	}
+
+	reference.Registry = _defaultRegistry
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		reference.Registry, name = name[:i], name[i+1:]
+	}
+	if reference.Registry == "index.docker.io" {
+		reference.Registry = _defaultRegistry
+	}
+	if reference.Registry == _defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	reference.Repository = name
+
+	if reference.Tag == "" && reference.Digest == "" {
+		reference.Tag = "latest"
+	}
+
+	reference.Image = reference.Registry + "/" + reference.Repository
+	if reference.Tag != "" {
+		reference.Image += ":" + reference.Tag
+	}
+	if reference.Digest != "" {
+		reference.Image += "@" + reference.Digest
+	}
+	return reference
+}
@@ -0,0 +1,84 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"testing"
+)
+
+func TestImagesSkipCompletedPods(t *testing.T) {
+	pod := func(name string, phase corev1.PodPhase, image string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+			Status: corev1.PodStatus{
+				Phase:             phase,
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "app", ImageID: image + "@sha256:" + name}},
+			},
+		}
+	}
+	pods := newTestInformer("Pods")
+
+	analyzer := NewImagesAnalyzer()
+	analyzer.Observe(pods, pod("running", corev1.PodRunning, "nginx:1.25"))
+	analyzer.Observe(pods, pod("succeeded", corev1.PodSucceeded, "nginx:1.25"))
+	analyzer.Observe(pods, pod("failed", corev1.PodFailed, "busybox:1.36"))
+
+	images := make(map[string]*altc.Image)
+	for _, record := range analyzer.Records(context.Background()) {
+		image := record.Data.(*altc.Image)
+		images[image.Image] = image
+	}
+	if len(images) != 1 {
+		t.Fatalf("images = %v, want only the running Pod's", images)
+	}
+	image, ok := images["docker.io/library/nginx:1.25"]
+	if !ok {
+		t.Fatalf("images = %v, want docker.io/library/nginx:1.25", images)
+	}
+	if image.Pods != 1 {
+		t.Errorf("pods = %d, want 1", image.Pods)
+	}
+	if len(image.Digests) != 1 || image.Digests[0] != "sha256:running" {
+		t.Errorf("digests = %v, want [sha256:running]", image.Digests)
+	}
+}
+
+func TestImagesSkipScaledDownReplicaSets(t *testing.T) {
+	controller := true
+	replicaSet := func(name string, replicas int32, running int32, image string) *appsv1.ReplicaSet {
+		return &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "web", Controller: &controller}}},
+			Spec: appsv1.ReplicaSetSpec{Replicas: &replicas, Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: image}},
+			}}},
+			Status: appsv1.ReplicaSetStatus{Replicas: running},
+		}
+	}
+	replicaSets := newTestInformer("ReplicaSets")
+
+	analyzer := NewImagesAnalyzer()
+	analyzer.Observe(replicaSets, replicaSet("web-1", 0, 0, "nginx:1.24"))
+	// Still terminating its Pods
+	analyzer.Observe(replicaSets, replicaSet("web-2", 0, 1, "nginx:1.25"))
+	analyzer.Observe(replicaSets, replicaSet("web-3", 2, 2, "nginx:1.26"))
+
+	var images []string
+	for _, record := range analyzer.Records(context.Background()) {
+		image := record.Data.(*altc.Image)
+		images = append(images, image.Image)
+		if len(image.Workloads) != 1 || image.Workloads[0].Kind != "Deployment" || image.Workloads[0].Name != "web" {
+			t.Errorf("workloads of %s = %v, want the Deployment", image.Image, image.Workloads)
+		}
+	}
+	sort.Strings(images)
+	if got, want := fmt.Sprint(images), "[docker.io/library/nginx:1.25 docker.io/library/nginx:1.26]"; got != want {
+		t.Errorf("images = %s, want %s", got, want)
+	}
+}
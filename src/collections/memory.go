@@ -0,0 +1,68 @@
+package collections
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"time"
+)
+
+const (
+	_heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+	// How often (in objects collected) the heap size is checked
+	_memoryCheckInterval = 100
+	_memoryWaitInterval  = 100 * time.Millisecond
+)
+
+// memoryLimiter
+//
+// Pauses collection while the heap exceeds the configured ceiling, giving the
+// send pipeline time to drain the buffered objects.
+type memoryLimiter struct {
+	limitBytes uint64
+	sample     []metrics.Sample
+	collected  int
+}
+
+func newMemoryLimiter(limitBytes uint64) *memoryLimiter {
+	return &memoryLimiter{
+		limitBytes: limitBytes,
+		sample:     []metrics.Sample{{Name: _heapObjectsMetric}},
+	}
+}
+
+func (m *memoryLimiter) heapBytes() uint64 {
+	metrics.Read(m.sample)
+	return m.sample[0].Value.Uint64()
+}
+
+// wait
+//
+// Called for each object collected. Blocks while the heap is over the limit
+// and there are buffered objects still to be sent; once the buffer is empty
+// waiting can't free any more memory, so collection continues regardless.
+func (m *memoryLimiter) wait(resourceObjects *ResourceObjects) {
+	if m.limitBytes == 0 {
+		return
+	}
+
+	m.collected++
+	if m.collected%_memoryCheckInterval != 0 || m.heapBytes() < m.limitBytes {
+		return
+	}
+
+	runtime.GC()
+	if m.heapBytes() < m.limitBytes {
+		return
+	}
+
+	fmt.Println(fmt.Sprintf("heap size over memory limit (%d bytes), pausing collection", m.limitBytes))
+	for resourceObjects.Count() > 0 && m.heapBytes() >= m.limitBytes {
+		select {
+		case <-time.After(_memoryWaitInterval):
+			runtime.GC()
+		case <-resourceObjects.done:
+			return
+		}
+	}
+}
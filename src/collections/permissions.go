@@ -0,0 +1,333 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	"fmt"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"math"
+	"sort"
+	"strings"
+)
+
+const PermissionsAnalyzerName = "permissions"
+
+// permissionsAnalyzer
+//
+// Resolves the RBAC objects into the effective permissions of each subject
+// bound to a role: the rules of the Roles and ClusterRoles (including the
+// ClusterRoles aggregated into others) granted by the RoleBindings, in their
+// namespace, and by the ClusterRoleBindings, in all namespaces. Sends a
+// permissions record per subject, which flags the permissions allowing the
+// subject to escalate its privileges.
+type permissionsAnalyzer struct {
+	clusterRoles map[string]*clusterRole
+	// Roles' rules, by namespace and name
+	roles    map[string][]rbacv1.PolicyRule
+	bindings []roleBinding
+}
+
+type clusterRole struct {
+	labels      labels.Set
+	rules       []rbacv1.PolicyRule
+	aggregation *rbacv1.AggregationRule
+	// Rules including those of the aggregated ClusterRoles, nil until resolved
+	resolved []rbacv1.PolicyRule
+}
+
+type roleBinding struct {
+	// altc.AllNamespaces for ClusterRoleBindings
+	namespace string
+	roleRef   rbacv1.RoleRef
+	subjects  []rbacv1.Subject
+}
+
+// permissionKey identifies the permissions granted on a resource (or a non-resource URL) in a namespace
+type permissionKey struct {
+	namespace, apiGroup, resource, resourceNames, nonResourceURL string
+}
+
+// subjectPermissions accumulates the verbs granted to a subject
+type subjectPermissions struct {
+	subject     altc.ObjectRef
+	verbs       map[permissionKey]map[string]bool
+	escalations map[altc.Escalation]bool
+}
+
+func NewPermissionsAnalyzer() Analyzer {
+	return &permissionsAnalyzer{
+		clusterRoles: make(map[string]*clusterRole),
+		roles:        make(map[string][]rbacv1.PolicyRule),
+	}
+}
+
+func (pa *permissionsAnalyzer) Name() string {
+	return PermissionsAnalyzerName
+}
+
+func (pa *permissionsAnalyzer) Observe(_ *altcinformers.Informer, obj interface{}) {
+	switch o := obj.(type) {
+	case *rbacv1.ClusterRole:
+		pa.clusterRoles[o.Name] = &clusterRole{labels: o.Labels, rules: o.Rules, aggregation: o.AggregationRule}
+	case *rbacv1.Role:
+		pa.roles[o.Namespace+"/"+o.Name] = o.Rules
+	case *rbacv1.RoleBinding:
+		pa.bindings = append(pa.bindings, roleBinding{namespace: o.Namespace, roleRef: o.RoleRef, subjects: o.Subjects})
+	case *rbacv1.ClusterRoleBinding:
+		pa.bindings = append(pa.bindings, roleBinding{namespace: altc.AllNamespaces, roleRef: o.RoleRef, subjects: o.Subjects})
+	}
+}
+
+func (pa *permissionsAnalyzer) Records(context.Context) []*altc.Record {
+	subjects := make(map[altc.ObjectRef]*subjectPermissions)
+	unresolved := 0
+	for _, binding := range pa.bindings {
+		rules, ok := pa.bindingRules(binding)
+		if !ok {
+			unresolved++
+			continue
+		}
+
+		for _, subject := range binding.subjects {
+			ref := altc.ObjectRef{Kind: subject.Kind, Name: subject.Name}
+			if subject.Kind == rbacv1.ServiceAccountKind {
+				ref.Namespace = subject.Namespace
+			}
+			permissions, ok := subjects[ref]
+			if !ok {
+				permissions = &subjectPermissions{
+					subject:     ref,
+					verbs:       make(map[permissionKey]map[string]bool),
+					escalations: make(map[altc.Escalation]bool),
+				}
+				subjects[ref] = permissions
+			}
+			permissions.grant(binding.namespace, rules)
+		}
+	}
+	if unresolved > 0 {
+		fmt.Println(fmt.Sprintf("WARN: %d bindings refer to roles that were not collected", unresolved))
+	}
+
+	records := make([]*altc.Record, 0, len(subjects))
+	for _, permissions := range subjects {
+		records = append(records, &altc.Record{Type: altc.PermissionsRecordType, Data: permissions.summary()})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i].Data.(*altc.SubjectPermissions).Subject, records[j].Data.(*altc.SubjectPermissions).Subject
+		return a.Kind+"/"+a.Namespace+"/"+a.Name < b.Kind+"/"+b.Namespace+"/"+b.Name
+	})
+	return records
+}
+
+// bindingRules returns the rules of the role a binding refers to, and whether it was found
+func (pa *permissionsAnalyzer) bindingRules(binding roleBinding) ([]rbacv1.PolicyRule, bool) {
+	if binding.roleRef.Kind == "Role" {
+		rules, ok := pa.roles[binding.namespace+"/"+binding.roleRef.Name]
+		return rules, ok
+	}
+	if _, ok := pa.clusterRoles[binding.roleRef.Name]; !ok {
+		return nil, false
+	}
+	rules, _ := pa.resolveClusterRole(binding.roleRef.Name, make(map[string]int))
+	return rules, true
+}
+
+// resolveClusterRole
+//
+// Returns the rules of a ClusterRole, including the rules of the
+// ClusterRoles its aggregation rule selects (the controller manager copies
+// them into the ClusterRole, but may not have done so yet). 'visiting' holds
+// the depth of the ClusterRoles being resolved; a ClusterRole aggregating one
+// of them (a cycle) skips it, and also returns the smallest depth skipped.
+// The rules are only kept once resolved if no ClusterRole outside of this
+// one was skipped, since they miss the skipped ClusterRole's rules otherwise.
+func (pa *permissionsAnalyzer) resolveClusterRole(name string, visiting map[string]int) ([]rbacv1.PolicyRule, int) {
+	role, ok := pa.clusterRoles[name]
+	if !ok {
+		return nil, math.MaxInt
+	}
+	if depth, ok := visiting[name]; ok {
+		return nil, depth
+	}
+	if role.resolved != nil {
+		return role.resolved, math.MaxInt
+	}
+	if role.aggregation == nil {
+		role.resolved = role.rules
+		return role.resolved, math.MaxInt
+	}
+
+	depth := len(visiting)
+	visiting[name] = depth
+	defer delete(visiting, name)
+	resolved := append([]rbacv1.PolicyRule{}, role.rules...)
+	skipped := math.MaxInt
+	for _, labelSelector := range role.aggregation.ClusterRoleSelectors {
+		selector, err := metav1.LabelSelectorAsSelector(&labelSelector)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("WARN: invalid aggregation rule of ClusterRole %s: %s", name, err))
+			continue
+		}
+		for aggregatedName, aggregated := range pa.clusterRoles {
+			if aggregatedName != name && selector.Matches(aggregated.labels) {
+				rules, aggregatedSkipped := pa.resolveClusterRole(aggregatedName, visiting)
+				resolved = append(resolved, rules...)
+				if aggregatedSkipped < skipped {
+					skipped = aggregatedSkipped
+				}
+			}
+		}
+	}
+	if skipped >= depth {
+		role.resolved = resolved
+	}
+	return resolved, skipped
+}
+
+// grant adds the verbs of the rules to the subject's permissions in the namespace
+func (sp *subjectPermissions) grant(namespace string, rules []rbacv1.PolicyRule) {
+	for _, rule := range rules {
+		// Non-resource URLs are only granted by ClusterRoleBindings
+		if namespace == altc.AllNamespaces {
+			for _, url := range rule.NonResourceURLs {
+				sp.addVerbs(permissionKey{namespace: namespace, nonResourceURL: url}, rule.Verbs)
+			}
+		}
+
+		resourceNames := strings.Join(rule.ResourceNames, ",")
+		for _, apiGroup := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				key := permissionKey{namespace: namespace, apiGroup: apiGroup, resource: resource, resourceNames: resourceNames}
+				sp.addVerbs(key, rule.Verbs)
+				for _, escalation := range escalations(apiGroup, resource, rule.Verbs) {
+					sp.escalations[altc.Escalation{Type: escalation, Namespace: namespace}] = true
+				}
+			}
+		}
+	}
+}
+
+func (sp *subjectPermissions) addVerbs(key permissionKey, verbs []string) {
+	keyVerbs, ok := sp.verbs[key]
+	if !ok {
+		keyVerbs = make(map[string]bool)
+		sp.verbs[key] = keyVerbs
+	}
+	for _, verb := range verbs {
+		keyVerbs[verb] = true
+	}
+}
+
+func (sp *subjectPermissions) summary() *altc.SubjectPermissions {
+	summary := &altc.SubjectPermissions{
+		Subject:     sp.subject,
+		Permissions: make([]altc.Permission, 0, len(sp.verbs)),
+	}
+
+	keys := make([]permissionKey, 0, len(sp.verbs))
+	for key := range sp.verbs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		if a.apiGroup != b.apiGroup {
+			return a.apiGroup < b.apiGroup
+		}
+		if a.resource != b.resource {
+			return a.resource < b.resource
+		}
+		if a.resourceNames != b.resourceNames {
+			return a.resourceNames < b.resourceNames
+		}
+		return a.nonResourceURL < b.nonResourceURL
+	})
+	for _, key := range keys {
+		permission := altc.Permission{
+			Namespace:      key.namespace,
+			APIGroup:       key.apiGroup,
+			Resource:       key.resource,
+			NonResourceURL: key.nonResourceURL,
+			Verbs:          sortedKeys(sp.verbs[key]),
+		}
+		if key.resourceNames != "" {
+			permission.ResourceNames = strings.Split(key.resourceNames, ",")
+		}
+		summary.Permissions = append(summary.Permissions, permission)
+	}
+
+	for escalation := range sp.escalations {
+		summary.Escalations = append(summary.Escalations, escalation)
+	}
+	sort.Slice(summary.Escalations, func(i, j int) bool {
+		a, b := summary.Escalations[i], summary.Escalations[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Namespace < b.Namespace
+	})
+	return summary
+}
+
+// escalations returns the escalations the verbs allow on a resource
+func escalations(apiGroup string, resource string, verbs []string) []string {
+	allows := func(allowed ...string) bool {
+		for _, verb := range verbs {
+			if verb == rbacv1.VerbAll {
+				return true
+			}
+			for _, a := range allowed {
+				if verb == a {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	inGroups := func(groups ...string) bool {
+		if apiGroup == rbacv1.APIGroupAll {
+			return true
+		}
+		for _, group := range groups {
+			if apiGroup == group {
+				return true
+			}
+		}
+		return false
+	}
+	isResource := func(resources ...string) bool {
+		if resource == rbacv1.ResourceAll {
+			return true
+		}
+		for _, r := range resources {
+			if resource == r {
+				return true
+			}
+		}
+		return false
+	}
+
+	var found []string
+	if inGroups(rbacv1.GroupName) && isResource("roles", "clusterroles") {
+		if allows("bind") {
+			found = append(found, altc.BindEscalation)
+		}
+		if allows("escalate") {
+			found = append(found, altc.EscalateEscalation)
+		}
+	}
+	if inGroups("", "authentication.k8s.io") && (isResource("users", "groups", "serviceaccounts", "uids") ||
+		strings.HasPrefix(resource, "userextras")) && allows("impersonate") {
+		found = append(found, altc.ImpersonateEscalation)
+	}
+	if inGroups("") && isResource("secrets") && allows("get", "list", "watch") {
+		found = append(found, altc.ReadSecretsEscalation)
+	}
+	return found
+}
@@ -0,0 +1,162 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	"context"
+	"fmt"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+)
+
+// permissionSummaries returns the permissions and the escalations of each subject, by subject name
+func permissionSummaries(records []*altc.Record) map[string]string {
+	summaries := make(map[string]string)
+	for _, record := range records {
+		permissions := record.Data.(*altc.SubjectPermissions)
+		lines := make([]string, 0)
+		for _, permission := range permissions.Permissions {
+			target := permission.APIGroup + "/" + permission.Resource
+			if permission.NonResourceURL != "" {
+				target = permission.NonResourceURL
+			}
+			if len(permission.ResourceNames) > 0 {
+				target += "[" + strings.Join(permission.ResourceNames, ",") + "]"
+			}
+			lines = append(lines, fmt.Sprintf("%s %s %s", permission.Namespace, target, strings.Join(permission.Verbs, ",")))
+		}
+		for _, escalation := range permissions.Escalations {
+			lines = append(lines, fmt.Sprintf("%s escalation %s", escalation.Namespace, escalation.Type))
+		}
+		summaries[permissions.Subject.Name] = strings.Join(lines, "; ")
+	}
+	return summaries
+}
+
+func TestPermissionsRecords(t *testing.T) {
+	user := func(name string) []rbacv1.Subject {
+		return []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: name}}
+	}
+	clusterRole := func(name string, labels map[string]string, selector map[string]string, rules ...rbacv1.PolicyRule) *rbacv1.ClusterRole {
+		role := &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}, Rules: rules}
+		if selector != nil {
+			role.AggregationRule = &rbacv1.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{{MatchLabels: selector}}}
+		}
+		return role
+	}
+	clusterRoleBinding := func(role string, subjects []rbacv1.Subject) *rbacv1.ClusterRoleBinding {
+		return &rbacv1.ClusterRoleBinding{RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: role}, Subjects: subjects}
+	}
+	rule := func(apiGroup string, resource string, verbs ...string) rbacv1.PolicyRule {
+		return rbacv1.PolicyRule{APIGroups: []string{apiGroup}, Resources: []string{resource}, Verbs: verbs}
+	}
+
+	tests := []struct {
+		name    string
+		objects []interface{}
+		// Summaries of the subjects' permissions (see permissionSummaries)
+		want map[string]string
+	}{
+		{
+			name: "aggregated cluster role",
+			objects: []interface{}{
+				clusterRole("view", nil, map[string]string{"aggregate-to-view": "true"}, rule("", "pods", "get")),
+				clusterRole("view-configmaps", map[string]string{"aggregate-to-view": "true"}, nil, rule("", "configmaps", "list")),
+				clusterRole("edit-configmaps", map[string]string{"aggregate-to-edit": "true"}, nil, rule("", "configmaps", "update")),
+				clusterRoleBinding("view", user("alice")),
+			},
+			want: map[string]string{"alice": "* /configmaps list; * /pods get"},
+		},
+		{
+			name: "aggregation cycle",
+			objects: []interface{}{
+				clusterRole("a", map[string]string{"aggregate-to-b": "true"}, map[string]string{"aggregate-to-a": "true"}, rule("", "configmaps", "get")),
+				clusterRole("b", map[string]string{"aggregate-to-a": "true"}, map[string]string{"aggregate-to-b": "true"}, rule("", "pods", "get")),
+				// Resolving a resolves b while a is being resolved
+				clusterRoleBinding("a", user("alice")),
+				clusterRoleBinding("b", user("bob")),
+			},
+			want: map[string]string{
+				"alice": "* /configmaps get; * /pods get",
+				"bob":   "* /configmaps get; * /pods get",
+			},
+		},
+		{
+			name: "role binding to a cluster role",
+			objects: []interface{}{
+				clusterRole("reader", nil, nil, rule("apps", "deployments", "get"),
+					rbacv1.PolicyRule{NonResourceURLs: []string{"/healthz"}, Verbs: []string{"get"}}),
+				&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "team"},
+					RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "reader"}, Subjects: user("alice")},
+				clusterRoleBinding("reader", user("bob")),
+			},
+			// Non-resource URLs are only granted by ClusterRoleBindings
+			want: map[string]string{
+				"alice": "team apps/deployments get",
+				"bob":   "* /healthz get; * apps/deployments get",
+			},
+		},
+		{
+			name: "role binding to a role",
+			objects: []interface{}{
+				&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "config"},
+					Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, ResourceNames: []string{"app"}, Verbs: []string{"get", "update"}}}},
+				&rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "config"}, Rules: []rbacv1.PolicyRule{rule("", "secrets", "get")}},
+				&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "team"},
+					RoleRef:  rbacv1.RoleRef{Kind: "Role", Name: "config"},
+					Subjects: []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Namespace: "team", Name: "app"}}},
+				// The role was not collected
+				&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "team"},
+					RoleRef: rbacv1.RoleRef{Kind: "Role", Name: "missing"}, Subjects: user("alice")},
+			},
+			want: map[string]string{"app": "team /configmaps[app] get,update"},
+		},
+		{
+			name: "escalations",
+			objects: []interface{}{
+				clusterRole("bind", nil, nil, rule(rbacv1.GroupName, "clusterroles", "bind")),
+				clusterRole("escalate", nil, nil, rule(rbacv1.GroupName, "roles", "escalate")),
+				clusterRole("impersonate", nil, nil, rule("", "serviceaccounts", "impersonate")),
+				clusterRole("read-secrets", nil, nil, rule("", "secrets", "list")),
+				clusterRole("read-configmaps", nil, nil, rule("", "configmaps", "get")),
+				clusterRoleBinding("bind", user("bind")),
+				clusterRoleBinding("escalate", user("escalate")),
+				clusterRoleBinding("impersonate", user("impersonate")),
+				&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Namespace: "team"},
+					RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "read-secrets"}, Subjects: user("read-secrets")},
+				clusterRoleBinding("read-configmaps", user("read-configmaps")),
+			},
+			want: map[string]string{
+				"bind":            "* rbac.authorization.k8s.io/clusterroles bind; * escalation bind",
+				"escalate":        "* rbac.authorization.k8s.io/roles escalate; * escalation escalate",
+				"impersonate":     "* /serviceaccounts impersonate; * escalation impersonate",
+				"read-secrets":    "team /secrets list; team escalation readSecrets",
+				"read-configmaps": "* /configmaps get",
+			},
+		},
+		{
+			name: "wildcard escalations",
+			objects: []interface{}{
+				clusterRole("admin", nil, nil, rule("*", "*", "*")),
+				clusterRoleBinding("admin", user("admin")),
+			},
+			want: map[string]string{
+				"admin": "* */* *; * escalation bind; * escalation escalate; * escalation impersonate; * escalation readSecrets",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			analyzer := NewPermissionsAnalyzer()
+			for _, obj := range test.objects {
+				analyzer.Observe(nil, obj)
+			}
+
+			got := permissionSummaries(analyzer.Records(context.Background()))
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("permissions = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const RelationshipsAnalyzerName = "relationships"
+
+// Cluster-scoped kinds that can own namespaced objects, other cluster-scoped
+// kinds (e.g. custom resources) are known once their objects are observed
+var clusterScopedKinds = map[string]bool{
+	"APIService":                     true,
+	"CertificateSigningRequest":      true,
+	"ClusterRole":                    true,
+	"ClusterRoleBinding":             true,
+	"CSIDriver":                      true,
+	"CSINode":                        true,
+	"CustomResourceDefinition":       true,
+	"IngressClass":                   true,
+	"MutatingWebhookConfiguration":   true,
+	"Namespace":                      true,
+	"Node":                           true,
+	"PersistentVolume":               true,
+	"PriorityClass":                  true,
+	"RuntimeClass":                   true,
+	"StorageClass":                   true,
+	"ValidatingWebhookConfiguration": true,
+	"VolumeAttachment":               true,
+}
+
+// relationshipsAnalyzer
+//
+// Builds the graph of the relationships between the snapshot's objects from
+// owner references, label selectors (Services, NetworkPolicies and
+// PodDisruptionBudgets selecting Pods), Endpoints, volumes, service accounts
+// and RBAC bindings, and sends its edges as relationship records. Selectors
+// are matched once all of the Pods have been observed; only the Pods' labels
+// are kept until then. Metadata-only objects contribute their owner
+// references only.
+type relationshipsAnalyzer struct {
+	relationships []*altc.Relationship
+	// Avoids duplicate edges, e.g. a Pod mounting a Secret in several volumes
+	seen map[altc.Relationship]bool
+	// Pods' labels, by namespace
+	pods      map[string][]labeledPod
+	selectors []podSelector
+	// Kinds of the cluster-scoped objects observed
+	clusterScoped map[string]bool
+}
+
+type labeledPod struct {
+	ref    altc.ObjectRef
+	labels labels.Set
+}
+
+// podSelector selects the Pods of a namespace
+type podSelector struct {
+	from     altc.ObjectRef
+	selector labels.Selector
+}
+
+func NewRelationshipsAnalyzer() Analyzer {
+	return &relationshipsAnalyzer{
+		seen:          make(map[altc.Relationship]bool),
+		pods:          make(map[string][]labeledPod),
+		clusterScoped: make(map[string]bool),
+	}
+}
+
+func (ra *relationshipsAnalyzer) Name() string {
+	return RelationshipsAnalyzerName
+}
+
+func (ra *relationshipsAnalyzer) Observe(informer *altcinformers.Informer, obj interface{}) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	ref := objectRef(informer, obj, accessor)
+	if ref.Namespace == "" {
+		ra.clusterScoped[ref.Kind] = true
+	}
+
+	// Owners are in the object's namespace, unless cluster-scoped (e.g. the
+	// Node owning a mirror Pod), which is resolved once all of the objects
+	// have been observed
+	for _, owner := range accessor.GetOwnerReferences() {
+		ra.add(altc.OwnsRelationship,
+			altc.ObjectRef{Kind: owner.Kind, Namespace: accessor.GetNamespace(), Name: owner.Name, UID: owner.UID}, ref)
+	}
+
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		ra.pods[o.Namespace] = append(ra.pods[o.Namespace], labeledPod{ref: ref, labels: o.Labels})
+		ra.observePod(ref, o)
+	case *corev1.Service:
+		// A Service without a selector has its Endpoints managed separately
+		if len(o.Spec.Selector) > 0 {
+			ra.selectors = append(ra.selectors, podSelector{from: ref, selector: labels.SelectorFromSet(o.Spec.Selector)})
+		}
+	case *corev1.Endpoints:
+		ra.add(altc.ExposesRelationship, altc.ObjectRef{Kind: "Service", Namespace: o.Namespace, Name: o.Name}, ref)
+		for _, subset := range o.Subsets {
+			for _, addresses := range [][]corev1.EndpointAddress{subset.Addresses, subset.NotReadyAddresses} {
+				for _, address := range addresses {
+					if address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
+						ra.add(altc.TargetsRelationship, ref, altc.ObjectRef{Kind: "Pod",
+							Namespace: address.TargetRef.Namespace, Name: address.TargetRef.Name, UID: address.TargetRef.UID})
+					}
+				}
+			}
+		}
+	case *corev1.PersistentVolumeClaim:
+		if o.Spec.VolumeName != "" {
+			ra.add(altc.BoundRelationship, ref, altc.ObjectRef{Kind: "PersistentVolume", Name: o.Spec.VolumeName})
+		}
+	case *networkingv1.NetworkPolicy:
+		ra.addLabelSelector(ref, &o.Spec.PodSelector)
+	case *policyv1.PodDisruptionBudget:
+		// A PodDisruptionBudget without a selector selects no Pods
+		if o.Spec.Selector != nil {
+			ra.addLabelSelector(ref, o.Spec.Selector)
+		}
+	case *rbacv1.RoleBinding:
+		roleNamespace := o.Namespace
+		if o.RoleRef.Kind == "ClusterRole" {
+			roleNamespace = ""
+		}
+		ra.add(altc.GrantsRelationship, ref, altc.ObjectRef{Kind: o.RoleRef.Kind, Namespace: roleNamespace, Name: o.RoleRef.Name})
+		ra.observeSubjects(ref, o.Subjects)
+	case *rbacv1.ClusterRoleBinding:
+		ra.add(altc.GrantsRelationship, ref, altc.ObjectRef{Kind: o.RoleRef.Kind, Name: o.RoleRef.Name})
+		ra.observeSubjects(ref, o.Subjects)
+	}
+}
+
+func (ra *relationshipsAnalyzer) observePod(ref altc.ObjectRef, pod *corev1.Pod) {
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	ra.add(altc.RunsAsRelationship, ref, altc.ObjectRef{Kind: "ServiceAccount", Namespace: pod.Namespace, Name: serviceAccountName})
+
+	for _, volume := range pod.Spec.Volumes {
+		switch {
+		case volume.PersistentVolumeClaim != nil:
+			ra.add(altc.MountsRelationship, ref, altc.ObjectRef{Kind: "PersistentVolumeClaim",
+				Namespace: pod.Namespace, Name: volume.PersistentVolumeClaim.ClaimName})
+		case volume.ConfigMap != nil:
+			ra.add(altc.MountsRelationship, ref, altc.ObjectRef{Kind: "ConfigMap",
+				Namespace: pod.Namespace, Name: volume.ConfigMap.Name})
+		case volume.Secret != nil:
+			ra.add(altc.MountsRelationship, ref, altc.ObjectRef{Kind: "Secret",
+				Namespace: pod.Namespace, Name: volume.Secret.SecretName})
+		}
+	}
+}
+
+func (ra *relationshipsAnalyzer) observeSubjects(binding altc.ObjectRef, subjects []rbacv1.Subject) {
+	for _, subject := range subjects {
+		subjectRef := altc.ObjectRef{Kind: subject.Kind, Name: subject.Name}
+		if subject.Kind == rbacv1.ServiceAccountKind {
+			subjectRef.Namespace = subject.Namespace
+		}
+		ra.add(altc.BindsRelationship, binding, subjectRef)
+	}
+}
+
+func (ra *relationshipsAnalyzer) addLabelSelector(from altc.ObjectRef, labelSelector *metav1.LabelSelector) {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("WARN: invalid selector of %s %s/%s: %s", from.Kind, from.Namespace, from.Name, err))
+		return
+	}
+	ra.selectors = append(ra.selectors, podSelector{from: from, selector: selector})
+}
+
+func (ra *relationshipsAnalyzer) add(relationshipType string, from altc.ObjectRef, to altc.ObjectRef) {
+	relationship := altc.Relationship{Type: relationshipType, From: from, To: to}
+	if ra.seen[relationship] {
+		return
+	}
+	ra.seen[relationship] = true
+	ra.relationships = append(ra.relationships, &relationship)
+}
+
+func (ra *relationshipsAnalyzer) Records(context.Context) []*altc.Record {
+	for _, selector := range ra.selectors {
+		for _, pod := range ra.pods[selector.from.Namespace] {
+			if selector.selector.Matches(pod.labels) {
+				ra.add(altc.SelectsRelationship, selector.from, pod.ref)
+			}
+		}
+	}
+
+	records := make([]*altc.Record, 0, len(ra.relationships))
+	for _, relationship := range ra.relationships {
+		if relationship.Type == altc.OwnsRelationship &&
+			(clusterScopedKinds[relationship.From.Kind] || ra.clusterScoped[relationship.From.Kind]) {
+			relationship.From.Namespace = ""
+		}
+		records = append(records, &altc.Record{Type: altc.RelationshipRecordType, Data: relationship})
+	}
+	return records
+}
+
+// objectRef returns a reference to an object collected by the informer
+func objectRef(informer *altcinformers.Informer, obj interface{}, object metav1.Object) altc.ObjectRef {
+	return altc.ObjectRef{Kind: objectKind(informer, obj), Namespace: object.GetNamespace(), Name: object.GetName(), UID: object.GetUID()}
+}
+
+// objectKind returns the kind of an object collected by the informer. Typed
+// objects in the informers' stores don't carry their kind, it is looked up
+// in the scheme.
+func objectKind(informer *altcinformers.Informer, obj interface{}) string {
+	if informer.Kind != "" {
+		return informer.Kind
+	}
+	if runtimeObject, ok := obj.(runtime.Object); ok {
+		if kinds, _, err := scheme.Scheme.ObjectKinds(runtimeObject); err == nil && len(kinds) > 0 {
+			return kinds[0].Kind
+		}
+	}
+	return ""
+}
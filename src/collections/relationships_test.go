@@ -0,0 +1,53 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestRelationshipsOwnerNamespace(t *testing.T) {
+	ownedBy := func(name string, owner metav1.OwnerReference) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, OwnerReferences: []metav1.OwnerReference{owner}}}
+	}
+	pods := newTestInformer("Pods")
+	widgets := newTestInformer("Widgets")
+	widgets.Kind = "Widget"
+
+	analyzer := NewRelationshipsAnalyzer()
+	analyzer.Observe(pods, ownedBy("web", metav1.OwnerReference{Kind: "ReplicaSet", Name: "web"}))
+	analyzer.Observe(pods, ownedBy("mirror", metav1.OwnerReference{Kind: "Node", Name: "node-1"}))
+	analyzer.Observe(pods, ownedBy("worker", metav1.OwnerReference{Kind: "Widget", Name: "widget"}))
+	analyzer.Observe(widgets, &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "widget"}})
+
+	owners := make(map[string]altc.ObjectRef)
+	for _, record := range analyzer.Records(context.Background()) {
+		relationship := record.Data.(*altc.Relationship)
+		if relationship.Type == altc.OwnsRelationship {
+			owners[relationship.To.Name] = relationship.From
+		}
+	}
+
+	tests := []struct {
+		pod       string
+		namespace string
+	}{
+		{pod: "web", namespace: "default"},
+		// Cluster-scoped kinds
+		{pod: "mirror"},
+		// Observed without a namespace
+		{pod: "worker"},
+	}
+	for _, test := range tests {
+		owner, ok := owners[test.pod]
+		if !ok {
+			t.Errorf("no owner of %s", test.pod)
+			continue
+		}
+		if owner.Namespace != test.namespace {
+			t.Errorf("owner %s %s of %s namespace = %q, want %q", owner.Kind, owner.Name, test.pod, owner.Namespace, test.namespace)
+		}
+	}
+}
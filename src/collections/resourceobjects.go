@@ -4,50 +4,80 @@ import (
 	"altc-agent/altc"
 	"errors"
 	"fmt"
-	"k8s.io/client-go/util/workqueue"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-const _resourceObjectQueueName = "altc-resourceObjectQ"
-
+// ResourceObjects
+//
+// A bounded buffer of the cluster objects being collected for a snapshot.
+// Objects are added as the informers' stores are walked and removed as
+// batches are built, so adding blocks while the buffer is full: the send
+// pipeline applies backpressure to collection rather than the whole snapshot
+// being held in memory.
 type ResourceObjects struct {
-	queue workqueue.Interface
+	items chan *altc.ClusterObjectItem
+	done  chan struct{}
 }
 
-func NewResourceObjects() *ResourceObjects {
-	queue := workqueue.NewNamed(_resourceObjectQueueName)
+var errResourceObjectsTerminated = errors.New("resource objects terminated")
 
+func NewResourceObjects(bufferSize int) *ResourceObjects {
 	return &ResourceObjects{
-		queue: queue,
+		items: make(chan *altc.ClusterObjectItem, bufferSize),
+		done:  make(chan struct{}),
 	}
 }
 
-func (ro *ResourceObjects) AddItem(action altc.Action, resourceObject altc.ResourceObject) error {
+func (ro *ResourceObjects) AddItem(action altc.Action, resourceObject altc.ResourceObject, findings []*altc.Finding) error {
 
 	clusterObjectItem, err := altc.NewClusterObjectItem(action, resourceObject)
 	if err != nil {
 		return errors.New(fmt.Sprintf("ERROR: unable to create %T: %s", altc.ClusterObjectItem{}, err))
 	}
+	clusterObjectItem.Findings = findings
 
-	ro.queue.Add(clusterObjectItem)
+	return ro.add(clusterObjectItem)
+}
 
-	return nil
+func (ro *ResourceObjects) AddMetadataItem(action altc.Action, kind string, objectMetadata *metav1.PartialObjectMetadata) error {
+	return ro.add(altc.NewMetadataClusterObjectItem(action, kind, objectMetadata))
 }
 
-func (ro *ResourceObjects) Terminate() {
-	ro.queue.ShutDown()
+// EndSnapshot
+//
+// Marks the end of the objects collected for the current snapshot. Get
+// returns a nil item once the objects added before the marker are consumed.
+func (ro *ResourceObjects) EndSnapshot() error {
+	return ro.add(nil)
 }
 
-func (ro *ResourceObjects) Count() int {
-	return ro.queue.Len()
+func (ro *ResourceObjects) add(item *altc.ClusterObjectItem) error {
+	select {
+	case ro.items <- item:
+		return nil
+	case <-ro.done:
+		return errResourceObjectsTerminated
+	}
 }
 
-func (ro *ResourceObjects) Get() (*altc.ClusterObjectItem, bool) {
+func (ro *ResourceObjects) Terminate() {
+	close(ro.done)
+}
 
-	obj, shutdown := ro.queue.Get()
-	returnItem := obj.(*altc.ClusterObjectItem)
-	return returnItem, shutdown
+// Count returns the number of objects currently buffered
+func (ro *ResourceObjects) Count() int {
+	return len(ro.items)
 }
 
-func (ro *ResourceObjects) Done(item interface{}) {
-	ro.queue.Done(item)
+// Get
+//
+// Blocks until an object is available. Returns a nil item at the end of a
+// snapshot (see EndSnapshot), and 'shutdown' once terminated.
+func (ro *ResourceObjects) Get() (*altc.ClusterObjectItem, bool) {
+	select {
+	case item := <-ro.items:
+		return item, false
+	case <-ro.done:
+		return nil, true
+	}
 }
@@ -3,23 +3,56 @@ package collections
 import (
 	"altc-agent/altc"
 	altcinformers "altc-agent/informers"
+	"altc-agent/posture"
 	"context"
+	"errors"
 	"fmt"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/client-go/util/workqueue"
+	"math"
+	"sync/atomic"
 	"time"
 )
 
-const _snapshotObjectsQName = "altc-snapshotObjectsQ"
+const (
+	_snapshotObjectsQName = "altc-snapshotObjectsQ"
+	// Records per batch when the batch limit is not set
+	_defaultRecordBatchLimit = 1000
+	// Times a batch that failed to send with a retryable error is requeued
+	// before it is dropped, each send making several attempts (see altc.Client.Send)
+	_maxBatchRequeues = 3
+)
 
 type SnapshotObjectsContext struct {
 	BatchLimit              int
 	SnapshotIntervalSeconds int
 	ClusterName             string
+	// Maximum size (bytes) of the encoded objects or records in a batch, before
+	// compression; zero to limit batches by BatchLimit only
+	BatchMaxBytes int
+	// How snapshots are sent: in batches (default) or streamed in a single request
+	SendMode SendMode
+	// Items between checkpoints when streaming
+	StreamCheckpointInterval int
+	// Size of the buffer of collected objects waiting to be batched
+	BufferSize int
+	// Collection pauses while the heap is larger than this; zero for no limit
+	MemoryLimitBytes uint64
+	// Number of batches sent concurrently
+	SendConcurrency int
+	// Names of the analyzers deriving records from the snapshots' objects
+	Analyzers []string
 }
 
+type SendMode string
+
+const (
+	BatchSendMode  SendMode = "batch"
+	StreamSendMode SendMode = "stream"
+)
+
 type SnapshotObjects struct {
 	SnapshotObjectsContext // Expose externally in order to log configuration
 
@@ -27,9 +60,23 @@ type SnapshotObjects struct {
 	resourceObjects *ResourceObjects
 	informers       []*altcinformers.Informer
 	client          *altc.Client
+	clusterIdentity *ClusterIdentity
+	analyzers       []AnalyzerFactory
+	// Evaluates the security posture rules against each object, nil if disabled
+	posture *posture.Evaluator
+
+	// Item that did not fit in the previous batch (when batching by size),
+	// and its encoded size
+	carryItem *altc.ClusterObjectItem
+	carrySize int
+
+	// Batches of the snapshot being sent
+	batches atomic.Pointer[batchTracker]
+	// Identity of the cluster, read at the start of each snapshot
+	clusterInfo atomic.Pointer[altc.ClusterInfo]
 }
 
-func NewSnapshotObjects(resourceObjects *ResourceObjects, informers []*altcinformers.Informer, context SnapshotObjectsContext) *SnapshotObjects {
+func NewSnapshotObjects(resourceObjects *ResourceObjects, informers []*altcinformers.Informer, client *altc.Client, clusterIdentity *ClusterIdentity, analyzers []AnalyzerFactory, posture *posture.Evaluator, context SnapshotObjectsContext) *SnapshotObjects {
 	queue := workqueue.NewNamed(_snapshotObjectsQName)
 
 	return &SnapshotObjects{
@@ -37,57 +84,49 @@ func NewSnapshotObjects(resourceObjects *ResourceObjects, informers []*altcinfor
 		queue:                  queue,
 		resourceObjects:        resourceObjects,
 		informers:              informers,
-		client:                 altc.NewClient(),
+		client:                 client,
+		clusterIdentity:        clusterIdentity,
+		analyzers:              analyzers,
+		posture:                posture,
 	}
 }
 
 func (so *SnapshotObjects) Loop(ctx context.Context) {
 
+	if so.SnapshotObjectsContext.SendMode != StreamSendMode {
+		concurrency := so.sendConcurrency()
+		fmt.Println(fmt.Sprintf("starting %d batch senders", concurrency))
+		for i := 0; i < concurrency; i++ {
+			go so.sendQueued(ctx)
+		}
+	}
+
 	for {
-		ready, stop := scheduleCollection(so.collectResourceObjects, time.Duration(so.SnapshotObjectsContext.SnapshotIntervalSeconds)*time.Second, ctx.Done())
+		ready, stop := scheduleCollection(time.Duration(so.SnapshotObjectsContext.SnapshotIntervalSeconds)*time.Second, ctx.Done())
 		select {
 		case <-ready:
-			fmt.Println("Number of cluster objects:", so.resourceObjects.Count())
 			snapshotId := uuid.NewUUID()
 			fmt.Println("snapshotId:", snapshotId)
 
-			// Process all resource objects in the snapshot, taking into account
-			// batch size
-			for ok := true; ok; ok = so.resourceObjects.Count() != 0 {
-				so.populate(snapshotId)
-				snapshotObject, shutdown := so.getSnapshotObject()
-
-				// TODO Add error handling on shutdown (controller needs to react)
-				if shutdown {
-					fmt.Println(fmt.Sprintf("%T shutdown", SnapshotObjects{}))
-					return
-				}
+			clusterInfo := so.clusterIdentity.ClusterInfo(ctx)
+			fmt.Println(fmt.Sprintf("cluster id: %s, server version: %s, platform: %s, nodes: %d",
+				clusterInfo.ClusterId, clusterInfo.ServerVersion, clusterInfo.Platform, clusterInfo.NodeCount))
+			so.clusterInfo.Store(clusterInfo)
 
-				itemsToSend := len(snapshotObject.Data)
-				err := so.client.Send(ctx, snapshotObject)
-
-				// Ack the snapshotObjects queue item regardless of whether the item
-				// was successfully sent to the server.
-				//
-				//  If the item was sent to the server:
-				//   The item needs to be acked to indicate the queue item is finished being
-				//   processed (the presence of items on the queue that are not finished being
-				//   processed will prevent the queue from being shutdown).
-				//
-				//  If the item was not successfully sent to the server:
-				//   The semantics of adding an item to a workqueue is such that the item won't be re-added if it
-				//   is still "processing". Therefore, the item needs to be acked before being
-				//   re-added.
-				//
-				so.queue.Done(snapshotObject)
-
-				if err != nil {
-					fmt.Println("ERROR: error sending resources to server:", err)
-					so.queue.Add(snapshotObject)
-					continue
-				}
-				fmt.Println(fmt.Sprintf("after sending %d items, resourceObjects len: %d",
-					itemsToSend, so.resourceObjects.Count()))
+			// Collect the objects in the background; the collected objects are
+			// batched or streamed as they become available, followed by the
+			// records derived from them.
+			synced, pendingKinds := so.partitionInformers()
+			var shutdown bool
+			if so.SnapshotObjectsContext.SendMode == StreamSendMode {
+				shutdown = so.sendStream(ctx, snapshotId, synced, pendingKinds)
+			} else {
+				records := make(chan []*altc.Record, 1)
+				go so.collectResourceObjects(ctx, synced, records)
+				shutdown = so.sendBatches(ctx, snapshotId, pendingKinds, records)
+			}
+			if shutdown {
+				return
 			}
 			break
 		case <-stop:
@@ -97,7 +136,128 @@ func (so *SnapshotObjects) Loop(ctx context.Context) {
 	}
 }
 
-func scheduleCollection(collect func(), delay time.Duration, done <-chan struct{}) (<-chan bool, <-chan bool) {
+// sendBatches
+//
+// Queues the snapshot's objects in batches as they are collected, then the
+// records derived from them, with at most SendConcurrency batches
+// outstanding at a time, and commits the snapshot once every batch has been
+// resolved. Returns whether the snapshot objects have been shut down.
+func (so *SnapshotObjects) sendBatches(ctx context.Context, snapshotId k8stypes.UID, pendingKinds []string, records <-chan []*altc.Record) bool {
+	batches := newBatchTracker(snapshotId)
+	so.batches.Store(batches)
+	concurrency := so.sendConcurrency()
+
+	// Process all resource objects in the snapshot, taking into account
+	// batch size
+	for collected, first := false, true; !collected; first = false {
+		if !batches.waitForCapacity(ctx, concurrency) {
+			fmt.Println(fmt.Sprintf("%T shutdown", SnapshotObjects{}))
+			return true
+		}
+
+		var shutdown bool
+		if collected, shutdown = so.populate(snapshotId, pendingKinds, first); shutdown {
+			fmt.Println(fmt.Sprintf("%T shutdown", ResourceObjects{}))
+			return true
+		}
+	}
+
+	// The records are available once all of the objects have been collected
+	snapshotRecords := <-records
+	recordBatchLimit := so.SnapshotObjectsContext.BatchLimit
+	if recordBatchLimit <= 0 {
+		recordBatchLimit = _defaultRecordBatchLimit
+	}
+	for _, recordBatch := range so.recordBatches(snapshotId, pendingKinds, snapshotRecords, recordBatchLimit) {
+		if !batches.waitForCapacity(ctx, concurrency) {
+			fmt.Println(fmt.Sprintf("%T shutdown", SnapshotObjects{}))
+			return true
+		}
+		so.queueRecords(snapshotId, pendingKinds, recordBatch)
+	}
+
+	if !batches.waitForAll(ctx) {
+		fmt.Println(fmt.Sprintf("%T shutdown", SnapshotObjects{}))
+		return true
+	}
+	batches.report()
+	so.commit(ctx, batches, pendingKinds)
+	return false
+}
+
+// sendQueued
+//
+// Sends batches from the snapshot objects queue until it is shut down.
+// Several senders run concurrently, so batches may be acknowledged out of
+// order; the batch tracker records which have been resolved.
+func (so *SnapshotObjects) sendQueued(ctx context.Context) {
+	for {
+		snapshotObject, shutdown := so.getSnapshotObject()
+
+		// TODO Add error handling on shutdown (controller needs to react)
+		if shutdown {
+			return
+		}
+
+		itemsToSend := len(snapshotObject.Data)
+		sendStats, err := so.client.Send(ctx, snapshotObject)
+
+		// Ack the snapshotObjects queue item regardless of whether the item
+		// was successfully sent to the server.
+		//
+		//  If the item was sent to the server:
+		//   The item needs to be acked to indicate the queue item is finished being
+		//   processed (the presence of items on the queue that are not finished being
+		//   processed will prevent the queue from being shutdown).
+		//
+		//  If the item was not successfully sent to the server:
+		//   The semantics of adding an item to a workqueue is such that the item won't be re-added if it
+		//   is still "processing". Therefore, the item needs to be acked before being
+		//   re-added.
+		//
+		so.queue.Done(snapshotObject)
+
+		if err != nil {
+			so.handleSendError(ctx, snapshotObject, err)
+			continue
+		}
+		so.batches.Load().acknowledge(snapshotObject.Sequence, itemsToSend, sendStats)
+		fmt.Println(fmt.Sprintf("after sending %d items, buffered resourceObjects: %d",
+			itemsToSend, so.resourceObjects.Count()))
+	}
+}
+
+// commit
+//
+// Tells the server the snapshot is complete once all of its batches have
+// been acknowledged. A snapshot with dropped batches is not committed, so the
+// server doesn't take it for a complete picture of the cluster.
+func (so *SnapshotObjects) commit(ctx context.Context, batches *batchTracker, pendingKinds []string) {
+	total, acknowledged, dropped := batches.counts()
+	if dropped > 0 {
+		fmt.Println(fmt.Sprintf("WARN: not committing snapshot %s, %d of %d batches were dropped",
+			batches.snapshotId, dropped, total))
+		return
+	}
+
+	replaced := batches.replacedSequences()
+	commit := altc.NewSnapshotCommit(so.SnapshotObjectsContext.ClusterName, batches.snapshotId, pendingKinds, total, replaced)
+	commit.ClusterInfo = so.clusterInfo.Load()
+	if _, err := so.client.Send(ctx, commit); err != nil {
+		fmt.Println(fmt.Sprintf("ERROR: unable to commit snapshot %s: %s", batches.snapshotId, err))
+		return
+	}
+	fmt.Println(fmt.Sprintf("committed snapshot %s: %d batches acknowledged, %d replaced", batches.snapshotId, acknowledged, len(replaced)))
+}
+
+func (so *SnapshotObjects) sendConcurrency() int {
+	if so.SnapshotObjectsContext.SendConcurrency < 1 {
+		return 1
+	}
+	return so.SnapshotObjectsContext.SendConcurrency
+}
+
+func scheduleCollection(delay time.Duration, done <-chan struct{}) (<-chan bool, <-chan bool) {
 	fmt.Println("scheduling snapshot object collection for", time.Now().Add(delay))
 
 	ready := make(chan bool)
@@ -106,7 +266,6 @@ func scheduleCollection(collect func(), delay time.Duration, done <-chan struct{
 		for {
 			select {
 			case <-time.After(delay):
-				collect()
 				ready <- true
 				return
 			case <-done:
@@ -119,103 +278,293 @@ func scheduleCollection(collect func(), delay time.Duration, done <-chan struct{
 	return ready, stop
 }
 
-func (so *SnapshotObjects) collectResourceObjects() {
-	// Shouldn't be collecting objects until all previously collected
-	// objects have been sent to the server
-	if so.queue.Len() != 0 {
-		fmt.Println("snapshotObjectsQ is not empty, not adding additional resources")
-		return
+// partitionInformers
+//
+// Splits the informers into those that have synced and the names of those
+// that have not. Objects of informers that have not synced are not collected,
+// the snapshot reports them as pending instead.
+func (so *SnapshotObjects) partitionInformers() ([]*altcinformers.Informer, []string) {
+	synced := make([]*altcinformers.Informer, 0, len(so.informers))
+	pending := make([]string, 0)
+	for _, informer := range so.informers {
+		if !informer.HasSynced() {
+			fmt.Println(fmt.Sprintf("%s informer has not synced, marking as pending", informer.Name))
+			pending = append(pending, informer.Name)
+			continue
+		}
+		synced = append(synced, informer)
 	}
+	return synced, pending
+}
 
+// collectResourceObjects
+//
+// Walks the stores of the informers, adding their objects to the
+// bounded resourceObjects buffer, followed by the end of snapshot marker.
+// Objects are looked up one at a time by key rather than listing each store
+// up front, so only the buffered objects are referenced by the collection.
+// The analyzers observe each object, and their records are sent to 'records'
+// before the end of snapshot marker is added.
+func (so *SnapshotObjects) collectResourceObjects(ctx context.Context, informers []*altcinformers.Informer, records chan<- []*altc.Record) {
 	fmt.Println("collecting snapshot objects at", time.Now())
-	for _, informer := range so.informers {
-		resourcesList := informer.Informer.GetStore().List()
-		fmt.Println(fmt.Sprintf("collecting %d objects from %s informer", len(resourcesList), informer.Name))
-		for _, item := range resourcesList {
-			so.addResourceObject(item)
+	memoryLimiter := newMemoryLimiter(so.SnapshotObjectsContext.MemoryLimitBytes)
+	analyzers := newSnapshotAnalyzers(so.analyzers)
+	total := 0
+
+	for _, informer := range informers {
+		store := informer.Informer.GetStore()
+		keys := store.ListKeys()
+		fmt.Println(fmt.Sprintf("collecting %d objects from %s informer", len(keys), informer.Name))
+		for _, key := range keys {
+			item, exists, err := store.GetByKey(key)
+			if err != nil || !exists {
+				// Deleted since the keys were listed
+				continue
+			}
+
+			analyzers.observe(informer, item)
+			if err := so.addResourceObject(informer, item); err == errResourceObjectsTerminated {
+				return
+			}
+			total++
+			memoryLimiter.wait(so.resourceObjects)
 		}
 	}
-	fmt.Println("finished collecting objects at", time.Now())
+
+	records <- analyzers.records(ctx)
+	if err := so.resourceObjects.EndSnapshot(); err != nil {
+		return
+	}
+	fmt.Println(fmt.Sprintf("finished collecting %d objects at %s", total, time.Now()))
 }
 
-func (so *SnapshotObjects) addResourceObject(obj interface{}) {
+func (so *SnapshotObjects) addResourceObject(informer *altcinformers.Informer, obj interface{}) error {
+	// TODO Is 'Action' useful? It is a relic of the initial implementation that used
+	// the event-driven model where the informers would send 'add/update/delete' events...
+	if informer.MetadataOnly {
+		objectMetadata, ok := obj.(*metav1.PartialObjectMetadata)
+		if !ok {
+			fmt.Println(fmt.Sprintf("WARN: 'obj' from %s metadata informer is %T, not metadata", informer.Name, obj))
+			return nil
+		}
+		return so.resourceObjects.AddMetadataItem("todo-remove-action-from-schema", informer.Kind, objectMetadata)
+	}
+
 	resourceObject, ok := obj.(altc.ResourceObject)
 	if !ok {
 		fmt.Println("WARN: 'obj' is not an altc.ResourceObject")
-		return
+		return nil
 	}
 
-	// Remove managed fields, if present
-	if metadata, ok := obj.(metav1.Object); !ok {
-		metadata.SetManagedFields(nil)
+	// Managed fields and other unneeded data are removed by the informers'
+	// transforms before objects are cached (see informers.TransformOptions)
+
+	var findings []*altc.Finding
+	if so.posture != nil {
+		findings = so.posture.Evaluate(resourceObject)
 	}
 
-	// TODO Is 'Action' useful? It is a relic of the initial implementation that used
-	// the event-driven model where the informers would send 'add/update/delete' events...
-	if err := so.resourceObjects.AddItem("todo-remove-action-from-schema", resourceObject); err != nil {
+	err := so.resourceObjects.AddItem("todo-remove-action-from-schema", resourceObject, findings)
+	if err != nil && err != errResourceObjectsTerminated {
 		fmt.Println(err.Error())
+		return nil
 	}
+	return err
 }
 
 // populate
 //
-// Add items to the snapshot objects queue, respecting
-// the batch size. If the queue is already populated,
-// does not add any additional resources.
-func (so *SnapshotObjects) populate(snapshotId k8stypes.UID) {
-	if so.queue.Len() > 0 {
-		fmt.Println(fmt.Sprintf("queue already populated, size: %d, not adding resource object items", so.queue.Len()))
-		return
+// Add the next batch of collected objects to the snapshot objects queue,
+// respecting the batch limit and, if set, the batch max bytes. Returns whether
+// all of the snapshot's objects have been collected. An empty batch is only
+// added if it is the first batch of the snapshot, so every snapshot is sent
+// to the server.
+func (so *SnapshotObjects) populate(snapshotId k8stypes.UID, pendingKinds []string, first bool) (collected bool, shutdown bool) {
+	batchLimit := so.SnapshotObjectsContext.BatchLimit
+	batchMaxBytes := so.SnapshotObjectsContext.BatchMaxBytes
+	if batchLimit <= 0 {
+		if batchMaxBytes > 0 {
+			batchLimit = math.MaxInt
+		} else {
+			batchLimit = 1
+		}
 	}
 
-	batchSize := so.updateBatchSize()
-	//fmt.Println("prior to adding resource objects, batch size updated to:", batchSize)
+	// Batches are sized with the encoding the client sends them with, less the
+	// envelope of the batch; a batch resent as json after the server rejected
+	// protobuf may exceed the limit, and is split if the server rejects it
+	encoding := so.snapshotEncoding()
+	itemMaxBytes := batchMaxBytes
+	if batchMaxBytes > 0 {
+		envelopeBytes := so.batchEnvelopeSize(snapshotId, pendingKinds, encoding)
+		if itemMaxBytes = batchMaxBytes - envelopeBytes; itemMaxBytes <= 0 && first {
+			fmt.Println(fmt.Sprintf("ERROR: the batch max bytes (%d) doesn't leave room for objects after the batch envelope (%d bytes)",
+				batchMaxBytes, envelopeBytes))
+		}
+	}
 
-	so.addResourcesWithBatchLimit(snapshotId, batchSize)
-}
+	resourceObjectItems := make([]*altc.ClusterObjectItem, 0)
+	batchBytes := 0
+	for len(resourceObjectItems) < batchLimit {
+		var item *altc.ClusterObjectItem
+		var size int
+		if so.carryItem != nil {
+			item, size = so.carryItem, so.carrySize
+			so.carryItem = nil
+		} else {
+			var shutdown bool
+			if item, shutdown = so.resourceObjects.Get(); shutdown {
+				return false, true
+			}
+			if item == nil {
+				collected = true
+				break
+			}
 
-func (so *SnapshotObjects) updateBatchSize() int {
-	batchLimit := so.SnapshotObjectsContext.BatchLimit
-	var batchSize int
+			if batchMaxBytes > 0 {
+				if item, size = fitItem(item, itemMaxBytes, encoding); item == nil {
+					continue
+				}
+			}
+		}
 
-	if so.resourceObjects.Count() > batchLimit {
-		batchSize = batchLimit
-	} else {
-		batchSize = so.resourceObjects.Count()
-		if batchSize == 0 {
-			batchSize = 1
+		if batchMaxBytes > 0 {
+			// Start the next batch with the item if it doesn't fit in this one
+			if len(resourceObjectItems) > 0 && batchBytes+size > itemMaxBytes {
+				so.carryItem, so.carrySize = item, size
+				break
+			}
+			batchBytes += size
 		}
+
+		resourceObjectItems = append(resourceObjectItems, item)
+	}
+
+	if len(resourceObjectItems) == 0 && !first {
+		return collected, false
 	}
-	return batchSize
+
+	so.queueBatch(snapshotId, pendingKinds, resourceObjectItems)
+	return collected, false
 }
 
-func (so *SnapshotObjects) addResourcesWithBatchLimit(snapshotId k8stypes.UID, batchSize int) {
-	//fmt.Println("adding", so.batchSize-so.queue.Len(), "items...")
-	resourceObjectItems := make([]*altc.ClusterObjectItem, 0, 0)
-	for i := so.queue.Len(); i < batchSize; i++ {
+// queueBatch adds a batch with the next sequence number to the snapshot objects queue
+func (so *SnapshotObjects) queueBatch(snapshotId k8stypes.UID, pendingKinds []string, items []*altc.ClusterObjectItem) {
+	sequence := so.batches.Load().next()
+	snapshotObject := &altc.SnapshotObject{
+		ClusterName:  so.SnapshotObjectsContext.ClusterName,
+		SnapshotId:   snapshotId,
+		PendingKinds: pendingKinds,
+		Sequence:     sequence,
+		BatchId:      altc.NewBatchId(snapshotId, sequence, items),
+		Data:         items,
+		ClusterInfo:  so.clusterInfo.Load(),
+	}
+	so.queue.Add(snapshotObject)
+}
 
-		item, shutdown := so.resourceObjects.Get()
-		//fmt.Println("adding resourceObject:", i+1)
-		if shutdown {
-			fmt.Println(fmt.Sprintf("%T shutdown", SnapshotObjects{}))
+// queueRecords adds a batch of records with the next sequence number to the snapshot objects queue
+func (so *SnapshotObjects) queueRecords(snapshotId k8stypes.UID, pendingKinds []string, records []*altc.Record) {
+	sequence := so.batches.Load().next()
+	snapshotObject := &altc.SnapshotObject{
+		ClusterName:  so.SnapshotObjectsContext.ClusterName,
+		SnapshotId:   snapshotId,
+		PendingKinds: pendingKinds,
+		Sequence:     sequence,
+		BatchId:      altc.NewRecordsBatchId(snapshotId, sequence, records),
+		Data:         []*altc.ClusterObjectItem{},
+		ClusterInfo:  so.clusterInfo.Load(),
+		Records:      records,
+	}
+	so.queue.Add(snapshotObject)
+}
+
+// handleSendError
+//
+// Decides what to do with a batch that could not be sent, based on the kind
+// of error: a batch rejected as too large is split, a batch rejected by the
+// server is dropped (resending it won't succeed, and the objects are sent
+// again with the next snapshot), and otherwise the batch is requeued, after
+// the delay requested by the server, if any. A batch that keeps failing is
+// dropped once it has been requeued _maxBatchRequeues times, so a failing
+// server doesn't hold up the snapshot, and later snapshots, indefinitely.
+func (so *SnapshotObjects) handleSendError(ctx context.Context, snapshotObject *altc.SnapshotObject, err error) {
+	batches := so.batches.Load()
+	switch altc.SendErrorKindOf(err) {
+	case altc.PayloadTooLargeSendError:
+		fmt.Println(fmt.Sprintf("batch %s is too large for the server, splitting", snapshotObject.BatchId))
+		so.splitBatch(snapshotObject)
+	case altc.PermanentSendError, altc.UnauthorizedSendError:
+		fmt.Println(fmt.Sprintf("ERROR: dropping batch %s (%d items): %s",
+			snapshotObject.BatchId, len(snapshotObject.Data), err))
+		batches.drop(snapshotObject.Sequence)
+	default:
+		fmt.Println("ERROR: error sending resources to server:", err)
+		if !batches.requeue(snapshotObject.Sequence, _maxBatchRequeues) {
+			fmt.Println(fmt.Sprintf("ERROR: dropping batch %s (%d items) after %d retries",
+				snapshotObject.BatchId, len(snapshotObject.Data), _maxBatchRequeues))
+			batches.drop(snapshotObject.Sequence)
 			return
 		}
+		var sendError *altc.SendError
+		if errors.As(err, &sendError) && sendError.RetryAfter > 0 {
+			fmt.Println("waiting to resend batch:", sendError.RetryAfter)
+			select {
+			case <-time.After(sendError.RetryAfter):
+			case <-ctx.Done():
+			}
+		}
+		so.queue.Add(snapshotObject)
+	}
+}
 
-		resourceObjectItems = append(resourceObjectItems, item)
-		so.resourceObjects.Done(item)
+// splitBatch
+//
+// Queues the halves of a batch the server rejected as too large, with new
+// sequence numbers, in place of the batch. A batch of a single object is
+// resent with the object truncated to its metadata, or dropped if it is
+// already truncated; a batch of a single record is dropped.
+func (so *SnapshotObjects) splitBatch(snapshotObject *altc.SnapshotObject) {
+	batches := so.batches.Load()
+	if records := snapshotObject.Records; len(records) > 0 {
+		if len(records) == 1 {
+			fmt.Println(fmt.Sprintf("ERROR: dropping batch %s, %s record too large for the server",
+				snapshotObject.BatchId, records[0].Type))
+			batches.drop(snapshotObject.Sequence)
+			return
+		}
+		defer batches.replace(snapshotObject.Sequence)
+		half := len(records) / 2
+		so.queueRecords(snapshotObject.SnapshotId, snapshotObject.PendingKinds, records[:half])
+		so.queueRecords(snapshotObject.SnapshotId, snapshotObject.PendingKinds, records[half:])
+		return
 	}
-	snapshotObject := &altc.SnapshotObject{
-		ClusterName: so.SnapshotObjectsContext.ClusterName,
-		SnapshotId:  snapshotId,
-		Data:        resourceObjectItems,
+
+	items := snapshotObject.Data
+	if len(items) <= 1 {
+		if len(items) == 0 || items[0].Truncated {
+			fmt.Println(fmt.Sprintf("ERROR: dropping batch %s, too large for the server", snapshotObject.BatchId))
+			batches.drop(snapshotObject.Sequence)
+			return
+		}
+		defer batches.replace(snapshotObject.Sequence)
+		fmt.Println(fmt.Sprintf("WARN: %s %s/%s is too large for the server, sending truncated to metadata",
+			items[0].Kind, items[0].Payload.GetNamespace(), items[0].Payload.GetName()))
+		so.queueBatch(snapshotObject.SnapshotId, snapshotObject.PendingKinds, []*altc.ClusterObjectItem{items[0].Truncate()})
+		return
 	}
-	so.queue.Add(snapshotObject)
+
+	defer batches.replace(snapshotObject.Sequence)
+	half := len(items) / 2
+	so.queueBatch(snapshotObject.SnapshotId, snapshotObject.PendingKinds, items[:half])
+	so.queueBatch(snapshotObject.SnapshotId, snapshotObject.PendingKinds, items[half:])
 }
 
 func (so *SnapshotObjects) getSnapshotObject() (*altc.SnapshotObject, bool) {
-	// TODO Consider making 'Populate' private and invoking the private 'populate' here
-	// (why does the caller need to invoke 'Populate' and then 'Get'?)
 	obj, shutdown := so.queue.Get()
+	if shutdown {
+		return nil, true
+	}
 	returnItem := obj.(*altc.SnapshotObject)
 	return returnItem, shutdown
 }
@@ -0,0 +1,317 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"altc-agent/posture"
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+	"time"
+)
+
+// newTestInformer returns an informer whose store holds the objects; the
+// informer is not run, collection only reads its store
+func newTestInformer(name string, objects ...interface{}) *altcinformers.Informer {
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &corev1.Pod{}, 0, cache.Indexers{})
+	for _, obj := range objects {
+		if err := informer.GetStore().Add(obj); err != nil {
+			panic(err)
+		}
+	}
+	return altcinformers.New(informer, name)
+}
+
+func testPods(count int) []interface{} {
+	pods := make([]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		pods = append(pods, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: fmt.Sprintf("pod-%d", i)}})
+	}
+	return pods
+}
+
+func testConfigMaps(count int) []interface{} {
+	configMaps := make([]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		configMaps = append(configMaps, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: fmt.Sprintf("cm-%d", i)}})
+	}
+	return configMaps
+}
+
+func newTestSnapshotObjects(bufferSize int, context SnapshotObjectsContext) *SnapshotObjects {
+	so := NewSnapshotObjects(NewResourceObjects(bufferSize), nil, nil, nil, nil, nil, context)
+	so.batches.Store(newBatchTracker("snapshot"))
+	return so
+}
+
+// collect walks the informers' stores in the background, returning the channel the records are sent to
+func collect(so *SnapshotObjects, informers ...*altcinformers.Informer) <-chan []*altc.Record {
+	records := make(chan []*altc.Record, 1)
+	go so.collectResourceObjects(context.Background(), informers, records)
+	return records
+}
+
+// populateAll builds batches until the snapshot's objects have been collected, returning the queued batches
+func populateAll(t *testing.T, so *SnapshotObjects) []*altc.SnapshotObject {
+	t.Helper()
+	for collected, first := false, true; !collected; first = false {
+		var shutdown bool
+		if collected, shutdown = so.populate("snapshot", nil, first); shutdown {
+			t.Fatal("resource objects shut down")
+		}
+	}
+
+	batches := make([]*altc.SnapshotObject, 0, so.queue.Len())
+	for so.queue.Len() > 0 {
+		snapshotObject, _ := so.getSnapshotObject()
+		so.queue.Done(snapshotObject)
+		batches = append(batches, snapshotObject)
+	}
+	return batches
+}
+
+func batchSizes(batches []*altc.SnapshotObject) []int {
+	sizes := make([]int, 0, len(batches))
+	for _, batch := range batches {
+		sizes = append(sizes, len(batch.Data))
+	}
+	return sizes
+}
+
+func batchItems(batches []*altc.SnapshotObject) []*altc.ClusterObjectItem {
+	items := make([]*altc.ClusterObjectItem, 0)
+	for _, batch := range batches {
+		items = append(items, batch.Data...)
+	}
+	return items
+}
+
+// waitFor polls the condition until it holds, failing the test after a second
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPopulateOrdering(t *testing.T) {
+	so := newTestSnapshotObjects(1, SnapshotObjectsContext{BatchLimit: 2})
+	records := collect(so, newTestInformer("Pods", testPods(3)...), newTestInformer("ConfigMaps", testConfigMaps(2)...))
+
+	batches := populateAll(t, so)
+	if got, want := fmt.Sprint(batchSizes(batches)), "[2 2 1]"; got != want {
+		t.Fatalf("batch sizes = %s, want %s", got, want)
+	}
+	for i, batch := range batches {
+		if batch.Sequence != i+1 {
+			t.Errorf("batch %d sequence = %d, want %d", i, batch.Sequence, i+1)
+		}
+	}
+
+	// The informers are walked in order
+	kinds := make([]string, 0)
+	names := make(map[string]bool)
+	for _, item := range batchItems(batches) {
+		kinds = append(kinds, item.Kind)
+		names[item.Payload.GetName()] = true
+	}
+	if got, want := fmt.Sprint(kinds), "[Pod Pod Pod ConfigMap ConfigMap]"; got != want {
+		t.Errorf("kinds = %s, want %s", got, want)
+	}
+	if len(names) != 5 {
+		t.Errorf("collected %d distinct objects, want 5", len(names))
+	}
+
+	select {
+	case <-records:
+	case <-time.After(time.Second):
+		t.Fatal("records were not sent")
+	}
+}
+
+func TestPopulateEmptySnapshot(t *testing.T) {
+	so := newTestSnapshotObjects(1, SnapshotObjectsContext{BatchLimit: 2})
+	collect(so, newTestInformer("Pods"))
+
+	// The first batch is sent even if empty, so every snapshot reaches the server
+	if got, want := fmt.Sprint(batchSizes(populateAll(t, so))), "[0]"; got != want {
+		t.Errorf("batch sizes = %s, want %s", got, want)
+	}
+}
+
+func TestCollectBackpressure(t *testing.T) {
+	so := newTestSnapshotObjects(2, SnapshotObjectsContext{BatchLimit: 10})
+	records := collect(so, newTestInformer("Pods", testPods(5)...))
+
+	// Collection blocks once the buffer is full, until batches are built
+	waitFor(t, "the buffer to fill", func() bool { return so.resourceObjects.Count() == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if count := so.resourceObjects.Count(); count != 2 {
+		t.Errorf("buffered objects = %d, want 2", count)
+	}
+	select {
+	case <-records:
+		t.Fatal("collection finished while the buffer was full")
+	default:
+	}
+
+	if got, want := fmt.Sprint(batchSizes(populateAll(t, so))), "[5]"; got != want {
+		t.Errorf("batch sizes = %s, want %s", got, want)
+	}
+	<-records
+}
+
+func TestPopulateCarriesItemAcrossBatches(t *testing.T) {
+	pods := testPods(5)
+	item, err := altc.NewClusterObjectItem("todo-remove-action-from-schema", pods[0].(*corev1.Pod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := altc.EncodedItemSize(item, altc.JSONEncoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two objects fit in a batch, the third is carried to the next
+	so := newTestSnapshotObjects(1, SnapshotObjectsContext{})
+	so.SnapshotObjectsContext.BatchMaxBytes = so.batchEnvelopeSize("snapshot", nil, altc.JSONEncoding) + 2*size + 1
+	collect(so, newTestInformer("Pods", pods...))
+
+	batches := populateAll(t, so)
+	if got, want := fmt.Sprint(batchSizes(batches)), "[2 2 1]"; got != want {
+		t.Fatalf("batch sizes = %s, want %s", got, want)
+	}
+	names := make(map[string]bool)
+	for _, item := range batchItems(batches) {
+		names[item.Payload.GetName()] = true
+	}
+	if len(names) != 5 {
+		t.Errorf("sent %d distinct objects, want 5: %v", len(names), names)
+	}
+	if so.carryItem != nil {
+		t.Errorf("item %s carried past the end of the snapshot", so.carryItem.Payload.GetName())
+	}
+}
+
+func TestMemoryLimiterResumes(t *testing.T) {
+	resourceObjects := NewResourceObjects(1)
+	if err := resourceObjects.EndSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The heap is always over a 1 byte limit, so collection pauses while objects are buffered
+	limiter := newMemoryLimiter(1)
+	limiter.collected = _memoryCheckInterval - 1
+	resumed := make(chan struct{})
+	go func() {
+		limiter.wait(resourceObjects)
+		close(resumed)
+	}()
+
+	select {
+	case <-resumed:
+		t.Fatal("collection did not pause with objects buffered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	resourceObjects.Get()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("collection did not resume once the buffer was drained")
+	}
+}
+
+func TestMemoryLimiterResumesOnTerminate(t *testing.T) {
+	resourceObjects := NewResourceObjects(1)
+	if err := resourceObjects.EndSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := newMemoryLimiter(1)
+	limiter.collected = _memoryCheckInterval - 1
+	resumed := make(chan struct{})
+	go func() {
+		limiter.wait(resourceObjects)
+		close(resumed)
+	}()
+
+	resourceObjects.Terminate()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("collection did not resume once terminated")
+	}
+}
+
+func TestHandleSendErrorRequeueLimit(t *testing.T) {
+	so := newTestSnapshotObjects(1, SnapshotObjectsContext{})
+	batches := so.batches.Load()
+	snapshotObject := &altc.SnapshotObject{SnapshotId: "snapshot", Sequence: batches.next(), Data: []*altc.ClusterObjectItem{}}
+	err := &altc.SendError{Kind: altc.RetryableSendError, StatusCode: 503}
+
+	for requeue := 1; requeue <= _maxBatchRequeues+1; requeue++ {
+		so.handleSendError(context.Background(), snapshotObject, err)
+		requeued := so.queue.Len() == 1
+		if requeued != (requeue <= _maxBatchRequeues) {
+			t.Fatalf("failure %d: requeued = %t", requeue, requeued)
+		}
+		if requeued {
+			queued, _ := so.getSnapshotObject()
+			so.queue.Done(queued)
+		}
+	}
+
+	// The snapshot is not committed with a dropped batch
+	if _, _, dropped := batches.counts(); dropped != 1 {
+		t.Errorf("dropped = %d, want 1", dropped)
+	}
+	if !batches.waitForAll(context.Background()) {
+		t.Error("dropped batch is still outstanding")
+	}
+}
+
+func TestAddResourceObjectPostureFindings(t *testing.T) {
+	privileged := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:            "app",
+			SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+		}}},
+	}
+	pods := newTestInformer("Pods")
+	podsMetadata := newTestInformer("Pods")
+	podsMetadata.Kind = "Pod"
+	podsMetadata.MetadataOnly = true
+
+	so := newTestSnapshotObjects(2, SnapshotObjectsContext{})
+	so.posture = posture.NewEvaluator(posture.DefaultRules())
+	for _, add := range []struct {
+		informer *altcinformers.Informer
+		obj      interface{}
+	}{
+		{pods, pod},
+		// Only the metadata of the object is collected, it isn't evaluated
+		{podsMetadata, &metav1.PartialObjectMetadata{ObjectMeta: pod.ObjectMeta}},
+	} {
+		if err := so.addResourceObject(add.informer, add.obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item, _ := so.resourceObjects.Get()
+	if len(item.Findings) == 0 {
+		t.Error("no findings for the privileged Pod")
+	}
+	if item, _ = so.resourceObjects.Get(); len(item.Findings) != 0 {
+		t.Errorf("metadata-only object has findings: %v", item.Findings)
+	}
+}
@@ -0,0 +1,84 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	"errors"
+	"fmt"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+var errSnapshotStreamShutdown = errors.New("resource objects shut down while streaming snapshot")
+
+// sendStream
+//
+// Streams the snapshot's objects to the server in a single request as they
+// are collected, followed by the records derived from them. The objects are
+// consumed as they are streamed, so each attempt at streaming the snapshot
+// collects them again. Returns whether the snapshot objects have been shut
+// down.
+func (so *SnapshotObjects) sendStream(ctx context.Context, snapshotId k8stypes.UID, informers []*altcinformers.Informer, pendingKinds []string) bool {
+	snapshotObject := &altc.SnapshotObject{
+		ClusterName:  so.SnapshotObjectsContext.ClusterName,
+		SnapshotId:   snapshotId,
+		PendingKinds: pendingKinds,
+		ClusterInfo:  so.clusterInfo.Load(),
+	}
+
+	open := func() altc.StreamSource {
+		records := make(chan []*altc.Record, 1)
+		go so.collectResourceObjects(ctx, informers, records)
+		return &snapshotStream{resourceObjects: so.resourceObjects, records: records}
+	}
+
+	_, err := so.client.SendStream(ctx, snapshotObject, open, so.SnapshotObjectsContext.StreamCheckpointInterval)
+	if errors.Is(err, errSnapshotStreamShutdown) {
+		fmt.Println(fmt.Sprintf("%T shutdown", ResourceObjects{}))
+		return true
+	}
+	if err != nil {
+		// The next snapshot will contain the current state of the cluster
+		fmt.Println("ERROR: error streaming snapshot to server:", err)
+	}
+	return false
+}
+
+// snapshotStream is the source of the objects and records of an attempt at streaming a snapshot
+type snapshotStream struct {
+	resourceObjects *ResourceObjects
+	records         <-chan []*altc.Record
+	// Set once the end of the snapshot's objects has been read
+	collected bool
+}
+
+func (ss *snapshotStream) Next() (*altc.ClusterObjectItem, error) {
+	item, shutdown := ss.resourceObjects.Get()
+	if shutdown {
+		return nil, errSnapshotStreamShutdown
+	}
+	if item == nil {
+		ss.collected = true
+	}
+	return item, nil
+}
+
+// Records is only called once Next has returned the end of the snapshot, by
+// which time the records have been sent
+func (ss *snapshotStream) Records() []*altc.Record {
+	return <-ss.records
+}
+
+// Close
+//
+// Discards the objects of the snapshot not streamed because of an error, so
+// the collection finishes and they are not included in the next attempt or
+// snapshot.
+func (ss *snapshotStream) Close() error {
+	for !ss.collected {
+		if _, err := ss.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
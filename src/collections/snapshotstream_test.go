@@ -0,0 +1,40 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	"testing"
+)
+
+// TestSnapshotStreamClose checks an attempt's unstreamed objects are
+// discarded, so the next attempt collects the snapshot again
+func TestSnapshotStreamClose(t *testing.T) {
+	so := newTestSnapshotObjects(1, SnapshotObjectsContext{})
+	informer := newTestInformer("Pods", testPods(3)...)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		records := make(chan []*altc.Record, 1)
+		go so.collectResourceObjects(context.Background(), []*altcinformers.Informer{informer}, records)
+		stream := &snapshotStream{resourceObjects: so.resourceObjects, records: records}
+
+		if item, err := stream.Next(); err != nil || item == nil {
+			t.Fatalf("attempt %d: Next() = %v, %v", attempt, item, err)
+		}
+		if err := stream.Close(); err != nil {
+			t.Fatalf("attempt %d: Close() = %v", attempt, err)
+		}
+		if count := so.resourceObjects.Count(); count != 0 {
+			t.Errorf("attempt %d: %d objects buffered after closing", attempt, count)
+		}
+	}
+}
+
+func TestSnapshotStreamCloseShutdown(t *testing.T) {
+	so := newTestSnapshotObjects(1, SnapshotObjectsContext{})
+	stream := &snapshotStream{resourceObjects: so.resourceObjects}
+	so.resourceObjects.Terminate()
+	if err := stream.Close(); err != errSnapshotStreamShutdown {
+		t.Errorf("Close() = %v, want %v", err, errSnapshotStreamShutdown)
+	}
+}
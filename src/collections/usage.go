@@ -0,0 +1,186 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	altcinformers "altc-agent/informers"
+	"context"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsclientset "k8s.io/metrics/pkg/client/clientset/versioned"
+	"sort"
+	"time"
+)
+
+const (
+	UsageAnalyzerName = "usage"
+
+	// Timeout of each list of the metrics, so an unresponsive metrics API
+	// doesn't hold up sending the snapshot
+	_metricsListTimeout = 30 * time.Second
+)
+
+// usageAnalyzer
+//
+// Collects the resource usage of the nodes and Pods from the metrics.k8s.io
+// API once the snapshot's objects have been observed, sent as a nodeUsage
+// record per node and a podUsage record per Pod, with the resources they
+// were allocated so utilization can be compared with requests. The API is
+// served by an optional add-on (e.g. metrics-server): if it isn't available,
+// or doesn't respond in time, the analyzer sends no records.
+type usageAnalyzer struct {
+	client metricsclientset.Interface
+	nodes  map[string]*usageNode
+	// Pods by namespace and name
+	pods map[string]*usagePod
+}
+
+type usageNode struct {
+	ref         altc.ObjectRef
+	allocatable altc.ResourceAmounts
+}
+
+type usagePod struct {
+	ref       altc.ObjectRef
+	node      string
+	completed bool
+	requested altc.ResourceAmounts
+	limits    altc.ResourceAmounts
+	// Requests and limits of the containers, by name
+	containers map[string]*altc.ContainerUsage
+}
+
+// NewUsageAnalyzerFactory returns the factory of usage analyzers using the metrics client
+func NewUsageAnalyzerFactory(client metricsclientset.Interface) AnalyzerFactory {
+	return func() Analyzer {
+		return &usageAnalyzer{
+			client: client,
+			nodes:  make(map[string]*usageNode),
+			pods:   make(map[string]*usagePod),
+		}
+	}
+}
+
+func (ua *usageAnalyzer) Name() string {
+	return UsageAnalyzerName
+}
+
+func (ua *usageAnalyzer) Observe(informer *altcinformers.Informer, obj interface{}) {
+	switch o := obj.(type) {
+	case *corev1.Node:
+		ua.nodes[o.Name] = &usageNode{ref: objectRef(informer, obj, o), allocatable: resourceAmounts(o.Status.Allocatable)}
+	case *corev1.Pod:
+		pod := &usagePod{
+			ref:        objectRef(informer, obj, o),
+			node:       o.Spec.NodeName,
+			completed:  podCompleted(o),
+			containers: make(map[string]*altc.ContainerUsage, len(o.Spec.Containers)),
+		}
+		pod.requested, pod.limits = podResources(o)
+		for _, container := range o.Spec.Containers {
+			pod.containers[container.Name] = &altc.ContainerUsage{
+				Name:      container.Name,
+				Requested: resourceAmounts(container.Resources.Requests),
+				Limits:    resourceAmounts(container.Resources.Limits),
+			}
+		}
+		ua.pods[o.Namespace+"/"+o.Name] = pod
+	}
+}
+
+func (ua *usageAnalyzer) Records(ctx context.Context) []*altc.Record {
+	metrics := ua.client.MetricsV1beta1()
+	listCtx, cancel := context.WithTimeout(ctx, _metricsListTimeout)
+	defer cancel()
+	nodeMetrics, err := metrics.NodeMetricses().List(listCtx, metav1.ListOptions{})
+	if apierrors.IsNotFound(err) || errors.Is(err, context.DeadlineExceeded) {
+		fmt.Println(fmt.Sprintf("metrics.k8s.io API is not available (is metrics-server installed?), usage not collected: %s", err))
+		return nil
+	}
+	if err != nil {
+		fmt.Println(fmt.Sprintf("WARN: unable to list node metrics: %s", err))
+		nodeMetrics = &metricsv1beta1.NodeMetricsList{}
+	}
+
+	listCtx, cancel = context.WithTimeout(ctx, _metricsListTimeout)
+	defer cancel()
+	podMetrics, err := metrics.PodMetricses(metav1.NamespaceAll).List(listCtx, metav1.ListOptions{})
+	if err != nil {
+		fmt.Println(fmt.Sprintf("WARN: unable to list pod metrics: %s", err))
+		podMetrics = &metricsv1beta1.PodMetricsList{}
+	}
+
+	records := make([]*altc.Record, 0, len(nodeMetrics.Items)+len(podMetrics.Items))
+	records = append(records, ua.nodeRecords(nodeMetrics.Items)...)
+	records = append(records, ua.podRecords(podMetrics.Items)...)
+	return records
+}
+
+func (ua *usageAnalyzer) nodeRecords(items []metricsv1beta1.NodeMetrics) []*altc.Record {
+	requested := make(map[string]altc.ResourceAmounts)
+	for _, pod := range ua.pods {
+		if pod.node != "" && !pod.completed {
+			requested[pod.node] = addResourceAmounts(requested[pod.node], pod.requested)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	records := make([]*altc.Record, 0, len(items))
+	for _, item := range items {
+		usage := &altc.NodeUsage{
+			Node:          altc.ObjectRef{Kind: "Node", Name: item.Name},
+			Timestamp:     item.Timestamp.Time,
+			WindowSeconds: item.Window.Duration.Seconds(),
+			Usage:         resourceAmounts(item.Usage),
+			Requested:     requested[item.Name],
+		}
+		if node, ok := ua.nodes[item.Name]; ok {
+			usage.Node = node.ref
+			usage.Allocatable = node.allocatable
+		}
+		records = append(records, &altc.Record{Type: altc.NodeUsageRecordType, Data: usage})
+	}
+	return records
+}
+
+func (ua *usageAnalyzer) podRecords(items []metricsv1beta1.PodMetrics) []*altc.Record {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Namespace != items[j].Namespace {
+			return items[i].Namespace < items[j].Namespace
+		}
+		return items[i].Name < items[j].Name
+	})
+	records := make([]*altc.Record, 0, len(items))
+	for _, item := range items {
+		usage := &altc.PodUsage{
+			Pod:           altc.ObjectRef{Kind: "Pod", Namespace: item.Namespace, Name: item.Name},
+			Timestamp:     item.Timestamp.Time,
+			WindowSeconds: item.Window.Duration.Seconds(),
+			Containers:    make([]altc.ContainerUsage, 0, len(item.Containers)),
+		}
+		pod, observed := ua.pods[item.Namespace+"/"+item.Name]
+		if observed {
+			usage.Pod = pod.ref
+			usage.Node = pod.node
+			usage.Requested = pod.requested
+			usage.Limits = pod.limits
+		}
+
+		for _, container := range item.Containers {
+			containerUsage := altc.ContainerUsage{Name: container.Name}
+			if observed {
+				if allocated, ok := pod.containers[container.Name]; ok {
+					containerUsage = *allocated
+				}
+			}
+			containerUsage.Usage = resourceAmounts(container.Usage)
+			usage.Usage = addResourceAmounts(usage.Usage, containerUsage.Usage)
+			usage.Containers = append(usage.Containers, containerUsage)
+		}
+		records = append(records, &altc.Record{Type: altc.PodUsageRecordType, Data: usage})
+	}
+	return records
+}
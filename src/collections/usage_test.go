@@ -0,0 +1,140 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsfake "k8s.io/metrics/pkg/client/clientset/versioned/fake"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestMetricsClient returns a fake metrics clientset serving the metrics
+func newTestMetricsClient(t *testing.T, nodes []*metricsv1beta1.NodeMetrics, pods []*metricsv1beta1.PodMetrics) *metricsfake.Clientset {
+	t.Helper()
+	client := metricsfake.NewSimpleClientset()
+	// The metrics' resources aren't the plural of their kinds, they are added to the tracker with theirs
+	for _, node := range nodes {
+		if err := client.Tracker().Create(metricsv1beta1.SchemeGroupVersion.WithResource("nodes"), node, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, pod := range pods {
+		if err := client.Tracker().Create(metricsv1beta1.SchemeGroupVersion.WithResource("pods"), pod, pod.Namespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return client
+}
+
+func TestUsageRecords(t *testing.T) {
+	timestamp := metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	window := metav1.Duration{Duration: 30 * time.Second}
+	usage := func(cpu string, memory string) corev1.ResourceList {
+		return corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu), corev1.ResourceMemory: resource.MustParse(memory)}
+	}
+	client := newTestMetricsClient(t,
+		[]*metricsv1beta1.NodeMetrics{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}, Timestamp: timestamp, Window: window, Usage: usage("1500m", "2Gi")}},
+		[]*metricsv1beta1.PodMetrics{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Timestamp:  timestamp,
+				Window:     window,
+				Containers: []metricsv1beta1.ContainerMetrics{
+					{Name: "app", Usage: usage("200m", "256Mi")},
+					{Name: "sidecar", Usage: usage("50m", "64Mi")},
+				},
+			},
+			// Not collected
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unknown"}, Timestamp: timestamp, Window: window},
+		})
+
+	nodes := newTestInformer("Nodes")
+	pods := newTestInformer("Pods")
+	analyzer := NewUsageAnalyzerFactory(client)()
+	analyzer.Observe(nodes, &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", UID: "node-uid"},
+		Status:     corev1.NodeStatus{Allocatable: usage("4", "8Gi")},
+	})
+	analyzer.Observe(pods, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "web-uid"},
+		Spec: corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{
+			{Name: "app", Resources: corev1.ResourceRequirements{Requests: usage("500m", "512Mi"), Limits: usage("1", "1Gi")}},
+			{Name: "sidecar"},
+		}},
+	})
+	// Completed Pods don't request the node's resources
+	analyzer.Observe(pods, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "job"},
+		Spec:       corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{{Name: "job", Resources: corev1.ResourceRequirements{Requests: usage("1", "1Gi")}}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodSucceeded},
+	})
+
+	records := analyzer.Records(context.Background())
+	if len(records) != 3 {
+		t.Fatalf("%d records, want 3", len(records))
+	}
+
+	node := records[0].Data.(*altc.NodeUsage)
+	if records[0].Type != altc.NodeUsageRecordType || node.Node.UID != "node-uid" {
+		t.Errorf("node record = %s %+v", records[0].Type, node)
+	}
+	if node.Usage.CPUMillicores != 1500 || node.Allocatable.CPUMillicores != 4000 || node.Requested.CPUMillicores != 500 {
+		t.Errorf("node usage = %+v, allocatable = %+v, requested = %+v", node.Usage, node.Allocatable, node.Requested)
+	}
+	if !node.Timestamp.Equal(timestamp.Time) || node.WindowSeconds != 30 {
+		t.Errorf("node timestamp = %s, window = %v", node.Timestamp, node.WindowSeconds)
+	}
+
+	// Pods are sorted by namespace and name
+	unknown := records[1].Data.(*altc.PodUsage)
+	if unknown.Pod.Name != "unknown" || unknown.Node != "" {
+		t.Errorf("unobserved pod record = %+v", unknown)
+	}
+
+	pod := records[2].Data.(*altc.PodUsage)
+	if records[2].Type != altc.PodUsageRecordType || pod.Pod.UID != "web-uid" || pod.Node != "node-1" {
+		t.Errorf("pod record = %s %+v", records[2].Type, pod)
+	}
+	if pod.Usage.CPUMillicores != 250 || pod.Usage.MemoryBytes != 320<<20 || pod.Requested.CPUMillicores != 500 || pod.Limits.MemoryBytes != 1<<30 {
+		t.Errorf("pod usage = %+v, requested = %+v, limits = %+v", pod.Usage, pod.Requested, pod.Limits)
+	}
+	containers := make([]string, 0, len(pod.Containers))
+	for _, container := range pod.Containers {
+		containers = append(containers, fmt.Sprintf("%s:%d/%d", container.Name, container.Usage.CPUMillicores, container.Requested.CPUMillicores))
+	}
+	if got, want := fmt.Sprint(containers), "[app:200/500 sidecar:50/0]"; got != want {
+		t.Errorf("containers = %s, want %s", got, want)
+	}
+}
+
+func TestUsageRecordsMetricsUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "API not found", err: apierrors.NewNotFound(metricsv1beta1.Resource("nodes"), "")},
+		{name: "timeout", err: &url.Error{Op: "Get", URL: "https://metrics", Err: context.DeadlineExceeded}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestMetricsClient(t,
+				[]*metricsv1beta1.NodeMetrics{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}}, nil)
+			client.PrependReactor("list", "*", func(k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, test.err
+			})
+
+			if records := NewUsageAnalyzerFactory(client)().Records(context.Background()); records != nil {
+				t.Errorf("records = %v, want none", records)
+			}
+		})
+	}
+}
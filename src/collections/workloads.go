@@ -0,0 +1,48 @@
+package collections
+
+import (
+	"altc-agent/altc"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// workloadControllers
+//
+// The workloads controlling ReplicaSets and Jobs (e.g. a Deployment or a
+// CronJob), by the kind, namespace and name of the ReplicaSet or Job, used
+// to attribute Pods to the workload ultimately controlling them.
+type workloadControllers map[workloadKey]altc.ObjectRef
+
+type workloadKey struct {
+	kind, namespace, name string
+}
+
+// observe records the workload controlling a ReplicaSet or Job
+func (wc workloadControllers) observe(ref altc.ObjectRef, object metav1.Object) {
+	if controller := metav1.GetControllerOf(object); controller != nil {
+		wc[workloadKey{ref.Kind, ref.Namespace, ref.Name}] =
+			altc.ObjectRef{Kind: controller.Kind, Namespace: ref.Namespace, Name: controller.Name, UID: controller.UID}
+	}
+}
+
+// resolve returns the workload ultimately controlling a workload, e.g. the
+// Deployment of a ReplicaSet or the CronJob of a Job
+func (wc workloadControllers) resolve(workload altc.ObjectRef) altc.ObjectRef {
+	// Controllers are at most two levels deep (e.g. CronJob, Job, Pod), the
+	// limit guards against cycles
+	for i := 0; i < 2; i++ {
+		controller, ok := wc[workloadKey{workload.Kind, workload.Namespace, workload.Name}]
+		if !ok {
+			break
+		}
+		workload = controller
+	}
+	return workload
+}
+
+// controllerRef returns the object controlling the object, or its own reference if it has no controller
+func controllerRef(ref altc.ObjectRef, object metav1.Object) altc.ObjectRef {
+	if controller := metav1.GetControllerOf(object); controller != nil {
+		return altc.ObjectRef{Kind: controller.Kind, Namespace: ref.Namespace, Name: controller.Name, UID: controller.UID}
+	}
+	return ref
+}
@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"altc-agent/collections"
+	"fmt"
+	metricsclientset "k8s.io/metrics/pkg/client/clientset/versioned"
+	"os"
+	"sort"
+)
+
+const (
+	// Analyzers deriving records from the snapshots' objects, e.g. "relationships";
+	// "none" to disable them
+	analyzersEnv = "ANALYZERS"
+)
+
+// Analyzers run unless ANALYZERS is set, with the cost analyzer if COST_NODE_PRICES is set
+var defaultAnalyzers = []string{collections.RelationshipsAnalyzerName, collections.ImagesAnalyzerName,
+	collections.PermissionsAnalyzerName, collections.CapacityAnalyzerName, collections.UsageAnalyzerName}
+
+// analyzerFactories returns the factories of the analyzers, by name
+func analyzerFactories(metricsClient metricsclientset.Interface) map[string]collections.AnalyzerFactory {
+	factories := map[string]collections.AnalyzerFactory{
+		collections.RelationshipsAnalyzerName: collections.NewRelationshipsAnalyzer,
+		collections.ImagesAnalyzerName:        collections.NewImagesAnalyzer,
+		collections.PermissionsAnalyzerName:   collections.NewPermissionsAnalyzer,
+		collections.CapacityAnalyzerName:      collections.NewCapacityAnalyzer,
+		collections.UsageAnalyzerName:         collections.NewUsageAnalyzerFactory(metricsClient),
+	}
+	if costFactory := newCostAnalyzerFactory(); costFactory != nil {
+		factories[collections.CostAnalyzerName] = costFactory
+	}
+	return factories
+}
+
+// newAnalyzers returns the configured analyzers and their names
+func newAnalyzers(metricsClient metricsclientset.Interface) ([]collections.AnalyzerFactory, []string) {
+	factories := analyzerFactories(metricsClient)
+	names := defaultAnalyzers
+	if _, ok := factories[collections.CostAnalyzerName]; ok {
+		names = append(append([]string{}, defaultAnalyzers...), collections.CostAnalyzerName)
+	}
+	if _, ok := os.LookupEnv(analyzersEnv); ok {
+		names = make([]string, 0)
+		for name := range envList(analyzersEnv) {
+			if name != noneValue {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	configuredFactories := make([]collections.AnalyzerFactory, 0, len(names))
+	configured := make([]string, 0, len(names))
+	for _, name := range names {
+		factory, ok := factories[name]
+		if name == collections.CostAnalyzerName && !ok {
+			fmt.Println(fmt.Sprintf("WARN: ignoring the %s analyzer, no node prices are configured in %s", name, costNodePricesEnv))
+			continue
+		}
+		if !ok {
+			fmt.Println(fmt.Sprintf("WARN: ignoring unknown analyzer in %s: %q", analyzersEnv, name))
+			continue
+		}
+		configuredFactories = append(configuredFactories, factory)
+		configured = append(configured, name)
+	}
+	return configuredFactories, configured
+}
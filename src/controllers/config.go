@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Value of list settings (e.g. ANALYZERS) disabling all of the options
+const noneValue = "none"
+
+// envInt returns the integer value of the environment variable 'name', or
+// 'defaultValue' if the variable is not set or is not an integer.
+func envInt(name string, defaultValue int) int {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return defaultValue
+	}
+
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("WARN: invalid value for %s (%q), using default: %d", name, value, defaultValue))
+		return defaultValue
+	}
+	return intValue
+}
+
+// envKindValues
+//
+// Parses the environment variable 'name' as a comma separated list of
+// '<informer name>=<value>' pairs (e.g. "Events=300,Secrets=60").
+func envKindValues(name string) map[string]string {
+	kindValues := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(name), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kind, value, found := strings.Cut(pair, "=")
+		if !found {
+			fmt.Println(fmt.Sprintf("WARN: ignoring malformed %s entry: %q", name, pair))
+			continue
+		}
+		kindValues[strings.TrimSpace(kind)] = strings.TrimSpace(value)
+	}
+	return kindValues
+}
+
+// envList
+//
+// Parses the environment variable 'name' as a comma separated list of
+// values, returned as a set.
+func envList(name string) map[string]bool {
+	values := make(map[string]bool)
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values[value] = true
+		}
+	}
+	return values
+}
@@ -9,26 +9,60 @@ import (
 	"fmt"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	metricsclientset "k8s.io/metrics/pkg/client/clientset/versioned"
 	"os"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Controller struct {
 	informers       []*altcinformers.Informer
 	informerFactory informers.SharedInformerFactory
-	resourceObjects *collections.ResourceObjects
-	snapshotObjects *collections.SnapshotObjects
-	client          *altc.Client
+	// Factory for the informers of kinds collected in metadata-only mode
+	metadataInformerFactory metadatainformer.SharedInformerFactory
+	resourceObjects         *collections.ResourceObjects
+	snapshotObjects         *collections.SnapshotObjects
+	client                  *altc.Client
+	credentials             *credentialsSource
 }
 
 const (
-	batchLimitEnv       = "BATCH_LIMIT"
-	snapshotIntervalEnv = "SNAPSHOT_INTERVAL_SECONDS"
+	batchLimitEnv          = "BATCH_LIMIT"
+	batchMaxBytesEnv       = "BATCH_MAX_BYTES"
+	snapshotIntervalEnv    = "SNAPSHOT_INTERVAL_SECONDS"
+	informerSyncTimeoutEnv = "INFORMER_SYNC_TIMEOUT_SECONDS"
+	// Per-informer overrides of the sync timeout, e.g. "Events=600,Secrets=60"
+	informerSyncTimeoutsEnv = "INFORMER_SYNC_TIMEOUTS"
+	// Informer names for which only metadata is collected, e.g. "Secrets,ConfigMaps,Events"
+	metadataOnlyKindsEnv = "METADATA_ONLY_KINDS"
+	// Transforms applied to objects before they are stored in the informers' caches
+	transformDropManagedFieldsEnv  = "TRANSFORM_DROP_MANAGED_FIELDS"
+	transformMaxAnnotationBytesEnv = "TRANSFORM_MAX_ANNOTATION_BYTES"
+	// Per-informer field paths to drop, e.g. "Pods=status.conditions;spec.volumes,*=metadata.labels"
+	transformDropFieldsEnv = "TRANSFORM_DROP_FIELDS"
+	// Number of collected objects buffered while waiting to be batched and sent
+	collectionBufferSizeEnv = "COLLECTION_BUFFER_SIZE"
+	// Memory ceiling (MiB): collection pauses while the heap exceeds it
+	memoryLimitEnv = "MEMORY_LIMIT_MIB"
+	// "batch" (default) or "stream" to send each snapshot in a single streamed request
+	sendModeEnv                 = "SEND_MODE"
+	streamCheckpointIntervalEnv = "STREAM_CHECKPOINT_INTERVAL"
+	// Number of batches sent concurrently
+	sendConcurrencyEnv = "SEND_CONCURRENCY"
+
+	defaultInformerSyncTimeoutSeconds = 120
+	defaultCollectionBufferSize       = 1000
+	defaultStreamCheckpointInterval   = 1000
+	defaultSendConcurrency            = 1
 )
 
-func New(clientset *kubernetes.Clientset, clusterName string) *Controller {
+func New(clientset *kubernetes.Clientset, metadataClient metadata.Interface, metricsClient metricsclientset.Interface,
+	clusterName string) (*Controller, error) {
 	// Documentation
 	//  The second argument is how often this informer should perform a resync.
 	//  What this means is it will list all resources and rehydrate the informer's store.
@@ -38,57 +72,136 @@ func New(clientset *kubernetes.Clientset, clusterName string) *Controller {
 	//  Setting to 0 disables resync.
 	f := informers.NewSharedInformerFactory(clientset, time.Duration(30*time.Minute))
 
-	informersList := []*altcinformers.Informer{
-		altcinformers.New(f.Core().V1().ConfigMaps().Informer(), "ConfigMaps"),
-		altcinformers.New(f.Core().V1().Endpoints().Informer(), "Endpoints"),
-		altcinformers.New(f.Core().V1().Events().Informer(), "Events"),
-		altcinformers.New(f.Core().V1().LimitRanges().Informer(), "LimitRanges"),
-		altcinformers.New(f.Core().V1().Namespaces().Informer(), "Namespaces"),
-		altcinformers.New(f.Core().V1().Nodes().Informer(), "Nodes"),
-		altcinformers.New(f.Core().V1().PersistentVolumeClaims().Informer(), "PersistentVolumeClaims"),
-		altcinformers.New(f.Core().V1().PodTemplates().Informer(), "PodTemplates"),
-		altcinformers.New(f.Core().V1().Pods().Informer(), "Pods"),
-		altcinformers.New(f.Core().V1().ReplicationControllers().Informer(), "ReplicationControllers"),
-		altcinformers.New(f.Core().V1().ResourceQuotas().Informer(), "ResourceQuotas"),
-		altcinformers.New(f.Core().V1().Secrets().Informer(), "Secrets"),
-		altcinformers.New(f.Core().V1().ServiceAccounts().Informer(), "ServiceAccounts"),
-		altcinformers.New(f.Core().V1().Services().Informer(), "Services"),
-		altcinformers.New(f.Apps().V1().Deployments().Informer(), "Deployments"),
-		altcinformers.New(f.Apps().V1().DaemonSets().Informer(), "DaemonSets"),
-		altcinformers.New(f.Apps().V1().ReplicaSets().Informer(), "ReplicaSets"),
-		altcinformers.New(f.Apps().V1().StatefulSets().Informer(), "StatefulSets"),
-		altcinformers.New(f.Batch().V1().CronJobs().Informer(), "CronJobs"),
-		altcinformers.New(f.Batch().V1().Jobs().Informer(), "Jobs"),
-		altcinformers.New(f.Networking().V1().Ingresses().Informer(), "Ingresses"),
-		altcinformers.New(f.Networking().V1().NetworkPolicies().Informer(), "NetworkPolicies"),
-		altcinformers.New(f.Rbac().V1().ClusterRoles().Informer(), "ClusterRoles"),
-		altcinformers.New(f.Rbac().V1().ClusterRoleBindings().Informer(), "ClusterRoleBindings"),
-		altcinformers.New(f.Rbac().V1().Roles().Informer(), "Roles"),
-		altcinformers.New(f.Rbac().V1().RoleBindings().Informer(), "RoleBindings"),
-		altcinformers.New(f.Storage().V1().CSIStorageCapacities().Informer(), "CSIStorageCapacities"),
+	// Kinds configured as metadata-only use the metadata informers, which list
+	// and watch only object metadata, rather than the typed informers
+	mf := metadatainformer.NewSharedInformerFactory(metadataClient, time.Duration(30*time.Minute))
+	metadataOnlyKinds := envList(metadataOnlyKindsEnv)
+	if len(metadataOnlyKinds) > 0 {
+		fmt.Println("collecting metadata only for:", os.Getenv(metadataOnlyKindsEnv))
+	}
+
+	informersList := make([]*altcinformers.Informer, 0, len(resources))
+	for _, r := range resources {
+		if metadataOnlyKinds[r.name] {
+			informersList = append(informersList,
+				altcinformers.NewMetadataOnly(mf.ForResource(r.gvr).Informer(), r.name, r.kind))
+			continue
+		}
+
+		genericInformer, err := f.ForResource(r.gvr)
+		if err != nil {
+			panic(fmt.Sprintf("unable to create %s informer: %s", r.name, err))
+		}
+		informersList = append(informersList, altcinformers.New(genericInformer.Informer(), r.name))
 	}
 
+	setSyncTimeouts(informersList)
+	setTransforms(informersList)
+
 	batchLimit, _ := strconv.Atoi(os.Getenv(batchLimitEnv))
 	snapshotIntervalSeconds, _ := strconv.Atoi(os.Getenv(snapshotIntervalEnv))
+	bufferSize := envInt(collectionBufferSizeEnv, defaultCollectionBufferSize)
+	memoryLimitBytes := uint64(envInt(memoryLimitEnv, 0)) * 1024 * 1024
+	if memoryLimitBytes > 0 {
+		// Also make the garbage collector work harder as the heap approaches the limit
+		debug.SetMemoryLimit(int64(memoryLimitBytes))
+	}
+
+	sendMode := collections.BatchSendMode
+	if collections.SendMode(os.Getenv(sendModeEnv)) == collections.StreamSendMode {
+		sendMode = collections.StreamSendMode
+	}
+
+	analyzers, analyzerNames := newAnalyzers(metricsClient)
 
 	context := collections.SnapshotObjectsContext{
-		BatchLimit:              batchLimit,
-		SnapshotIntervalSeconds: snapshotIntervalSeconds,
-		ClusterName:             clusterName,
+		BatchLimit:               batchLimit,
+		BatchMaxBytes:            envInt(batchMaxBytesEnv, 0),
+		SendMode:                 sendMode,
+		StreamCheckpointInterval: envInt(streamCheckpointIntervalEnv, defaultStreamCheckpointInterval),
+		SnapshotIntervalSeconds:  snapshotIntervalSeconds,
+		ClusterName:              clusterName,
+		BufferSize:               bufferSize,
+		MemoryLimitBytes:         memoryLimitBytes,
+		SendConcurrency:          envInt(sendConcurrencyEnv, defaultSendConcurrency),
+		Analyzers:                analyzerNames,
 	}
 
-	resourceObjects := collections.NewResourceObjects()
-	snapshotObjects := collections.NewSnapshotObjects(resourceObjects, informersList, context)
+	// The client is shared, so the snapshots are sent with the credential
+	// obtained when registering
+	credentials := newCredentialsSource(clientset)
+	client, err := altc.NewClient(credentials.secrets)
+	if err != nil {
+		return nil, err
+	}
+	resourceObjects := collections.NewResourceObjects(bufferSize)
+	snapshotObjects := collections.NewSnapshotObjects(resourceObjects, informersList, client,
+		collections.NewClusterIdentity(clientset, informersList), analyzers, newPostureEvaluator(), context)
 
 	return &Controller{
-		informers:       informersList,
-		informerFactory: f,
-		resourceObjects: resourceObjects,
-		snapshotObjects: snapshotObjects,
-		client:          altc.NewClient(),
+		informers:               informersList,
+		informerFactory:         f,
+		metadataInformerFactory: mf,
+		resourceObjects:         resourceObjects,
+		snapshotObjects:         snapshotObjects,
+		client:                  client,
+		credentials:             credentials,
+	}, nil
+}
+
+// setSyncTimeouts
+//
+// Applies the default informer sync timeout and any per-informer overrides.
+func setSyncTimeouts(informersList []*altcinformers.Informer) {
+	defaultTimeoutSeconds := envInt(informerSyncTimeoutEnv, defaultInformerSyncTimeoutSeconds)
+	overrides := envKindValues(informerSyncTimeoutsEnv)
+
+	for _, informer := range informersList {
+		timeoutSeconds := defaultTimeoutSeconds
+		if override, ok := overrides[informer.Name]; ok {
+			if seconds, err := strconv.Atoi(override); err == nil {
+				timeoutSeconds = seconds
+			} else {
+				fmt.Println(fmt.Sprintf("WARN: invalid sync timeout for %s informer: %q", informer.Name, override))
+			}
+		}
+		informer.SyncTimeout = time.Duration(timeoutSeconds) * time.Second
+	}
+}
+
+// setTransforms
+//
+// Configures the informers to trim objects before caching them: managed fields
+// (unless disabled), annotations larger than the configured size and the
+// configured field paths. Field paths listed for '*' apply to all informers.
+func setTransforms(informersList []*altcinformers.Informer) {
+	dropManagedFields := os.Getenv(transformDropManagedFieldsEnv) != "false"
+	maxAnnotationBytes := envInt(transformMaxAnnotationBytesEnv, 0)
+	dropFields := envKindValues(transformDropFieldsEnv)
+
+	for _, informer := range informersList {
+		options := altcinformers.TransformOptions{
+			DropManagedFields:  dropManagedFields,
+			MaxAnnotationBytes: maxAnnotationBytes,
+			DropFieldPaths:     append(fieldPaths(dropFields["*"]), fieldPaths(dropFields[informer.Name])...),
+		}
+
+		if err := informer.SetTransform(options); err != nil {
+			fmt.Println(fmt.Sprintf("WARN: unable to set transform on %s informer: %s", informer.Name, err))
+		}
 	}
 }
 
+func fieldPaths(value string) []string {
+	paths := make([]string, 0)
+	for _, path := range strings.Split(value, ";") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
 func (c *Controller) Run(stopCh <-chan struct{}, ctx context.Context) {
 	fmt.Println("****")
 	fmt.Println("controller running")
@@ -96,7 +209,8 @@ func (c *Controller) Run(stopCh <-chan struct{}, ctx context.Context) {
 	fmt.Println("snapshot objects context:", string(snapshotObjectsContextBytes))
 	fmt.Println("starting informers...")
 	fmt.Println("****")
-	c.informerFactory.Start(stopCh) // runs in background
+	c.informerFactory.Start(stopCh)         // runs in background
+	c.metadataInformerFactory.Start(stopCh) // runs in background
 
 	go func() {
 		<-ctx.Done()
@@ -104,6 +218,7 @@ func (c *Controller) Run(stopCh <-chan struct{}, ctx context.Context) {
 		c.snapshotObjects.Terminate()
 	}()
 
+	c.credentials.start(ctx)
 	if err := c.client.Register(ctx); err != nil {
 		fmt.Println("ERROR registering client:", err)
 		return
@@ -120,28 +235,43 @@ func (c *Controller) run(ctx context.Context) {
 		return
 	}
 
-	fmt.Println("informers' caches have synced")
+	fmt.Println("finished waiting for informers' caches to sync")
 
 	c.snapshotObjects.Loop(ctx)
 }
 
+// waitForInformersToSync
+//
+// Waits for each informer's cache to sync, giving up on an informer once its
+// sync timeout elapses. Informers that have not synced by then are reported
+// as pending in the snapshots and are collected once they have synced.
+// Returns an error only if the context is done.
 func (c *Controller) waitForInformersToSync(ctx context.Context) error {
-	cacheSyncs := make([]cache.InformerSynced, 0, len(c.informers))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	pending := make([]string, 0)
+
 	for _, informer := range c.informers {
-		cacheSyncs = append(cacheSyncs, func() bool {
-			hasSynced := informer.Informer.HasSynced()
-			if !hasSynced {
-				fmt.Println(fmt.Sprintf("Informer cache for %s has not been synced", informer.Name))
+		wg.Add(1)
+		go func(informer *altcinformers.Informer) {
+			defer wg.Done()
+			if !informer.WaitForSync(ctx) {
+				mu.Lock()
+				pending = append(pending, informer.Name)
+				mu.Unlock()
 			}
+		}(informer)
+	}
+	wg.Wait()
 
-			return hasSynced
-		})
+	if ctx.Err() != nil {
+		return fmt.Errorf("informers sync failed: %w", ctx.Err())
 	}
 
-	if !cache.WaitForCacheSync(ctx.Done(), cacheSyncs...) {
-		return fmt.Errorf("informers sync failed")
+	if len(pending) > 0 {
+		fmt.Println(fmt.Sprintf("WARN: informer caches not synced within timeout, proceeding without: %s",
+			strings.Join(pending, ", ")))
 	}
 
 	return nil
-
 }
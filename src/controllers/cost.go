@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"altc-agent/collections"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Hourly prices of the nodes by instance type, e.g.
+	// "m5.large=0.096,m5.xlarge=0.192,*=0.1" ('*' prices the other nodes);
+	// the cost analyzer is disabled if not set
+	costNodePricesEnv = "COST_NODE_PRICES"
+	// Labels of the Pods to roll their costs up by, e.g. "team,app"
+	costLabelsEnv = "COST_LABELS"
+)
+
+// newCostAnalyzerFactory returns the factory of cost analyzers of the configured model, nil if no prices are configured
+func newCostAnalyzerFactory() collections.AnalyzerFactory {
+	if _, ok := os.LookupEnv(costNodePricesEnv); !ok {
+		return nil
+	}
+
+	model := collections.CostModel{NodePrices: make(map[string]float64)}
+	prices := make([]string, 0)
+	for instanceType, value := range envKindValues(costNodePricesEnv) {
+		price, err := strconv.ParseFloat(value, 64)
+		if err != nil || price < 0 {
+			fmt.Println(fmt.Sprintf("WARN: ignoring invalid %s entry: %s=%s", costNodePricesEnv, instanceType, value))
+			continue
+		}
+		model.NodePrices[instanceType] = price
+		prices = append(prices, fmt.Sprintf("%s=%g", instanceType, price))
+	}
+	if len(model.NodePrices) == 0 {
+		fmt.Println(fmt.Sprintf("WARN: no valid node prices in %s, cost analyzer disabled", costNodePricesEnv))
+		return nil
+	}
+	for label := range envList(costLabelsEnv) {
+		model.Labels = append(model.Labels, label)
+	}
+	sort.Strings(prices)
+	sort.Strings(model.Labels)
+
+	fmt.Println(fmt.Sprintf("cost model: node prices %s, labels [%s]", strings.Join(prices, ", "), strings.Join(model.Labels, ", ")))
+	return collections.NewCostAnalyzerFactory(model)
+}
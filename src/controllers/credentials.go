@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"altc-agent/altc"
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Secret holding the agent's credentials, "[<namespace>/]<name>", read
+	// and watched through the API; the namespace defaults to the agent's
+	credentialsSecretEnv = "AUTH_CREDENTIALS_SECRET"
+	// Directory where the credentials Secret is mounted, as an alternative to
+	// reading it through the API; only one of them can be set
+	credentialsDirEnv = "AUTH_CREDENTIALS_DIR"
+
+	credentialsDirInterval     = 30 * time.Second
+	credentialsSecretSyncLimit = 30 * time.Second
+	serviceAccountNamespace    = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// credentialsSource
+//
+// Keeps the agent's credentials up to date with the credentials Secret,
+// either watching the Secret through the API or polling its mounted files.
+type credentialsSource struct {
+	secrets *altc.Secrets
+	// Watches the credentials Secret, nil if it is not read through the API
+	informerFactory informers.SharedInformerFactory
+	informer        cache.SharedIndexInformer
+	// Mounted credentials Secret, empty if not mounted
+	dir string
+}
+
+func newCredentialsSource(clientset kubernetes.Interface) *credentialsSource {
+	secret, dir := os.Getenv(credentialsSecretEnv), os.Getenv(credentialsDirEnv)
+	if secret != "" && dir != "" {
+		// Each would replace the other's values whenever it is read
+		panic(fmt.Sprintf("both %s and %s are set, set only one", credentialsSecretEnv, credentialsDirEnv))
+	}
+	source := &credentialsSource{secrets: altc.NewSecrets()}
+
+	if secret != "" {
+		namespace, name := agentNamespace(), secret
+		if i := strings.Index(secret, "/"); i >= 0 {
+			namespace, name = secret[:i], secret[i+1:]
+		}
+		fmt.Println(fmt.Sprintf("reading credentials from secret %s/%s", namespace, name))
+
+		// Watch only the credentials Secret
+		source.informerFactory = informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+			}))
+		source.informer = source.informerFactory.Core().V1().Secrets().Informer()
+		source.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    source.update,
+			UpdateFunc: func(_, obj interface{}) { source.update(obj) },
+			DeleteFunc: func(interface{}) {
+				fmt.Println("WARN: credentials secret deleted, keeping the current credentials")
+			},
+		})
+	}
+
+	if dir != "" {
+		fmt.Println("reading credentials from", dir)
+		source.dir = dir
+		if err := source.secrets.LoadDir(dir); err != nil {
+			fmt.Println(fmt.Sprintf("WARN: unable to read credentials from %s: %s", dir, err))
+		}
+	}
+
+	return source
+}
+
+// start starts watching the credentials Secret, waiting for it to be read
+// so the agent registers with the current credentials
+func (cs *credentialsSource) start(ctx context.Context) {
+	if cs.informerFactory != nil {
+		cs.informerFactory.Start(ctx.Done())
+
+		syncCtx, cancel := context.WithTimeout(ctx, credentialsSecretSyncLimit)
+		defer cancel()
+		if !cache.WaitForCacheSync(syncCtx.Done(), cs.informer.HasSynced) {
+			fmt.Println("WARN: credentials secret not read, using the credentials from the environment")
+		}
+	}
+
+	if cs.dir != "" {
+		go cs.secrets.WatchDir(ctx, cs.dir, credentialsDirInterval)
+	}
+}
+
+func (cs *credentialsSource) update(obj interface{}) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	cs.secrets.Update(secret.Data)
+}
+
+// agentNamespace returns the agent's namespace: POD_NAMESPACE, or the service account's namespace
+func agentNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	if namespace, err := os.ReadFile(serviceAccountNamespace); err == nil {
+		return strings.TrimSpace(string(namespace))
+	}
+	return metav1.NamespaceDefault
+}
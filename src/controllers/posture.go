@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"altc-agent/posture"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// Security posture rules evaluated against the collected objects, e.g.
+	// "privileged-container,host-path-volume"; all of the rules if not set,
+	// "none" to disable them
+	postureRulesEnv = "POSTURE_RULES"
+	// Per-rule severity overrides, e.g. "run-as-root=high,missing-resource-limits=low"
+	postureSeveritiesEnv = "POSTURE_SEVERITIES"
+)
+
+// newPostureEvaluator returns the evaluator of the configured rules, nil if none are enabled
+func newPostureEvaluator() *posture.Evaluator {
+	rules := posture.DefaultRules()
+	known := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		known[rule.Id] = true
+	}
+
+	if _, ok := os.LookupEnv(postureRulesEnv); ok {
+		enabled := envList(postureRulesEnv)
+		for id := range enabled {
+			if !known[id] && id != noneValue {
+				fmt.Println(fmt.Sprintf("WARN: ignoring unknown rule in %s: %q", postureRulesEnv, id))
+			}
+		}
+		selected := make([]posture.Rule, 0, len(rules))
+		for _, rule := range rules {
+			if enabled[rule.Id] {
+				selected = append(selected, rule)
+			}
+		}
+		rules = selected
+	}
+
+	severities := envKindValues(postureSeveritiesEnv)
+	for id, severity := range severities {
+		if !known[id] || !posture.ValidSeverity(severity) {
+			fmt.Println(fmt.Sprintf("WARN: ignoring invalid %s entry: %s=%s", postureSeveritiesEnv, id, severity))
+		}
+	}
+	ids := make([]string, 0, len(rules))
+	for i := range rules {
+		if severity, ok := severities[rules[i].Id]; ok && posture.ValidSeverity(severity) {
+			rules[i].Severity = severity
+		}
+		ids = append(ids, fmt.Sprintf("%s (%s)", rules[i].Id, rules[i].Severity))
+	}
+
+	if len(rules) == 0 {
+		fmt.Println("security posture rules disabled")
+		return nil
+	}
+	fmt.Println("security posture rules:", strings.Join(ids, ", "))
+	return posture.NewEvaluator(rules)
+}
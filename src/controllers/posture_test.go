@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"altc-agent/posture"
+	"fmt"
+	"testing"
+)
+
+func TestNewPostureEvaluator(t *testing.T) {
+	defaults := make(map[string]string)
+	for _, rule := range posture.DefaultRules() {
+		defaults[rule.Id] = rule.Severity
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		// Severities of the enabled rules, nil if the evaluator is disabled
+		want map[string]string
+	}{
+		{name: "all rules by default", want: defaults},
+		{
+			name: "selected rules",
+			env:  map[string]string{postureRulesEnv: " privileged-container, wildcard-role ,unknown-rule"},
+			want: map[string]string{"privileged-container": posture.HighSeverity, "wildcard-role": posture.HighSeverity},
+		},
+		{name: "none", env: map[string]string{postureRulesEnv: "none"}},
+		{name: "no valid rules", env: map[string]string{postureRulesEnv: "unknown-rule"}},
+		{
+			name: "severity overrides",
+			env: map[string]string{
+				postureRulesEnv:      "run-as-root,missing-resource-limits,host-path-volume",
+				postureSeveritiesEnv: "run-as-root=high, missing-resource-limits=critical,unknown-rule=low,host-path-volume",
+			},
+			// Invalid severities are ignored
+			want: map[string]string{
+				"run-as-root":             posture.HighSeverity,
+				"missing-resource-limits": posture.MediumSeverity,
+				"host-path-volume":        posture.HighSeverity,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			evaluator := newPostureEvaluator()
+			if test.want == nil {
+				if evaluator != nil {
+					t.Fatalf("rules = %v, want none", evaluator.Rules())
+				}
+				return
+			}
+			if evaluator == nil {
+				t.Fatal("rules disabled")
+			}
+			got := make(map[string]string)
+			for _, rule := range evaluator.Rules() {
+				got[rule.Id] = rule.Severity
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("rules = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
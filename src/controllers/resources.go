@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// resource describes a kind of cluster object collected by the agent
+type resource struct {
+	// Informer name, also used to refer to the resource in configuration
+	name string
+	kind string
+	gvr  schema.GroupVersionResource
+}
+
+var resources = []resource{
+	{"ConfigMaps", "ConfigMap", corev1.SchemeGroupVersion.WithResource("configmaps")},
+	{"Endpoints", "Endpoints", corev1.SchemeGroupVersion.WithResource("endpoints")},
+	{"Events", "Event", corev1.SchemeGroupVersion.WithResource("events")},
+	{"LimitRanges", "LimitRange", corev1.SchemeGroupVersion.WithResource("limitranges")},
+	{"Namespaces", "Namespace", corev1.SchemeGroupVersion.WithResource("namespaces")},
+	{"Nodes", "Node", corev1.SchemeGroupVersion.WithResource("nodes")},
+	{"PersistentVolumeClaims", "PersistentVolumeClaim", corev1.SchemeGroupVersion.WithResource("persistentvolumeclaims")},
+	{"PodTemplates", "PodTemplate", corev1.SchemeGroupVersion.WithResource("podtemplates")},
+	{"Pods", "Pod", corev1.SchemeGroupVersion.WithResource("pods")},
+	{"ReplicationControllers", "ReplicationController", corev1.SchemeGroupVersion.WithResource("replicationcontrollers")},
+	{"ResourceQuotas", "ResourceQuota", corev1.SchemeGroupVersion.WithResource("resourcequotas")},
+	{"Secrets", "Secret", corev1.SchemeGroupVersion.WithResource("secrets")},
+	{"ServiceAccounts", "ServiceAccount", corev1.SchemeGroupVersion.WithResource("serviceaccounts")},
+	{"Services", "Service", corev1.SchemeGroupVersion.WithResource("services")},
+	{"Deployments", "Deployment", appsv1.SchemeGroupVersion.WithResource("deployments")},
+	{"DaemonSets", "DaemonSet", appsv1.SchemeGroupVersion.WithResource("daemonsets")},
+	{"ReplicaSets", "ReplicaSet", appsv1.SchemeGroupVersion.WithResource("replicasets")},
+	{"StatefulSets", "StatefulSet", appsv1.SchemeGroupVersion.WithResource("statefulsets")},
+	{"CronJobs", "CronJob", batchv1.SchemeGroupVersion.WithResource("cronjobs")},
+	{"Jobs", "Job", batchv1.SchemeGroupVersion.WithResource("jobs")},
+	{"Ingresses", "Ingress", networkingv1.SchemeGroupVersion.WithResource("ingresses")},
+	{"NetworkPolicies", "NetworkPolicy", networkingv1.SchemeGroupVersion.WithResource("networkpolicies")},
+	{"PodDisruptionBudgets", "PodDisruptionBudget", policyv1.SchemeGroupVersion.WithResource("poddisruptionbudgets")},
+	{"ClusterRoles", "ClusterRole", rbacv1.SchemeGroupVersion.WithResource("clusterroles")},
+	{"ClusterRoleBindings", "ClusterRoleBinding", rbacv1.SchemeGroupVersion.WithResource("clusterrolebindings")},
+	{"Roles", "Role", rbacv1.SchemeGroupVersion.WithResource("roles")},
+	{"RoleBindings", "RoleBinding", rbacv1.SchemeGroupVersion.WithResource("rolebindings")},
+	{"CSIStorageCapacities", "CSIStorageCapacity", storagev1.SchemeGroupVersion.WithResource("csistoragecapacities")},
+}
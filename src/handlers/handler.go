@@ -51,7 +51,7 @@ func (h *handler) handle(action altc.Action, obj interface{}) {
 		metadata.SetManagedFields(nil)
 	}
 
-	err := h.resourceObjects.AddItem(action, resourceObject)
+	err := h.resourceObjects.AddItem(action, resourceObject, nil)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
@@ -1,12 +1,25 @@
 package informers
 
 import (
+	"context"
 	"k8s.io/client-go/tools/cache"
+	"time"
 )
 
 type Informer struct {
 	Name     string
 	Informer cache.SharedInformer
+
+	// Kind of the objects in the informer's store. Only set for metadata-only
+	// informers, whose objects do not carry their kind.
+	Kind string
+	// MetadataOnly indicates the informer's store contains
+	// metav1.PartialObjectMetadata objects rather than full objects
+	MetadataOnly bool
+
+	// SyncTimeout is how long to wait for the informer's cache to sync before
+	// proceeding without it. Zero means wait indefinitely.
+	SyncTimeout time.Duration
 }
 
 func New(informer cache.SharedInformer, name string) *Informer {
@@ -21,3 +34,34 @@ func New(informer cache.SharedInformer, name string) *Informer {
 		Informer: informer,
 	}
 }
+
+// NewMetadataOnly
+//
+// Creates an Informer for a metadata informer (see metadatainformer), whose
+// store holds only the metadata of the 'kind' objects.
+func NewMetadataOnly(informer cache.SharedInformer, name string, kind string) *Informer {
+	return &Informer{
+		Name:         name,
+		Informer:     informer,
+		Kind:         kind,
+		MetadataOnly: true,
+	}
+}
+
+func (i *Informer) HasSynced() bool {
+	return i.Informer.HasSynced()
+}
+
+// WaitForSync
+//
+// Blocks until the informer's cache has synced, the informer's sync timeout
+// has elapsed, or the context is done. Returns whether the cache has synced.
+func (i *Informer) WaitForSync(ctx context.Context) bool {
+	if i.SyncTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.SyncTimeout)
+		defer cancel()
+	}
+
+	return cache.WaitForCacheSync(ctx.Done(), i.Informer.HasSynced)
+}
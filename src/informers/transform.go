@@ -0,0 +1,101 @@
+package informers
+
+import (
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"strings"
+)
+
+// TransformOptions
+//
+// Describes how objects are trimmed before they are stored in an informer's
+// cache, so the cache only holds what is sent to the server.
+type TransformOptions struct {
+	DropManagedFields bool
+	// Annotations with values larger than this (in bytes) are dropped.
+	// Zero keeps all annotations.
+	MaxAnnotationBytes int
+	// Dot separated field paths removed from each object, e.g. "status.images"
+	DropFieldPaths []string
+}
+
+func (o TransformOptions) isEmpty() bool {
+	return !o.DropManagedFields && o.MaxAnnotationBytes == 0 && len(o.DropFieldPaths) == 0
+}
+
+// SetTransform
+//
+// Configures the informer to trim objects according to 'options' as they are
+// added to its cache. Must be called before the informer is started.
+func (i *Informer) SetTransform(options TransformOptions) error {
+	if options.isEmpty() {
+		return nil
+	}
+	return i.Informer.SetTransform(NewTransform(options))
+}
+
+// NewTransform returns a cache.TransformFunc that trims objects according to 'options'
+func NewTransform(options TransformOptions) cache.TransformFunc {
+	fieldPaths := make([][]string, 0, len(options.DropFieldPaths))
+	for _, fieldPath := range options.DropFieldPaths {
+		fieldPaths = append(fieldPaths, strings.Split(fieldPath, "."))
+	}
+
+	return func(obj interface{}) (interface{}, error) {
+		// Objects are freshly decoded from the API server and not yet shared
+		// with the cache, so they can be modified in place.
+		metadata, ok := obj.(metav1.Object)
+		if !ok {
+			// e.g. cache.DeletedFinalStateUnknown
+			return obj, nil
+		}
+
+		if options.DropManagedFields {
+			metadata.SetManagedFields(nil)
+		}
+
+		if options.MaxAnnotationBytes > 0 {
+			dropLargeAnnotations(metadata, options.MaxAnnotationBytes)
+		}
+
+		if len(fieldPaths) > 0 {
+			return dropFields(obj, fieldPaths)
+		}
+
+		return obj, nil
+	}
+}
+
+func dropLargeAnnotations(metadata metav1.Object, maxBytes int) {
+	annotations := metadata.GetAnnotations()
+	for key, value := range annotations {
+		if len(value) > maxBytes {
+			delete(annotations, key)
+		}
+	}
+}
+
+// dropFields
+//
+// Removes the field paths from 'obj' by round-tripping it through its
+// unstructured representation. Returns a new object of the same type.
+func dropFields(obj interface{}, fieldPaths [][]string) (interface{}, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert %T to unstructured: %w", obj, err)
+	}
+
+	for _, fieldPath := range fieldPaths {
+		unstructured.RemoveNestedField(u, fieldPath...)
+	}
+
+	trimmed := reflect.New(reflect.TypeOf(obj).Elem()).Interface()
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u, trimmed); err != nil {
+		return nil, fmt.Errorf("unable to convert unstructured to %T: %w", obj, err)
+	}
+	return trimmed, nil
+}
@@ -4,7 +4,9 @@ import (
 	"altc-agent/controllers"
 	"context"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
+	metricsclientset "k8s.io/metrics/pkg/client/clientset/versioned"
 	"os"
 )
 
@@ -20,6 +22,16 @@ func main() {
 		panic(err.Error())
 	}
 
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	metricsClient, err := metricsclientset.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 
@@ -28,6 +40,9 @@ func main() {
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
 
-	controller := controllers.New(clientset, clusterName)
+	controller, err := controllers.New(clientset, metadataClient, metricsClient, clusterName)
+	if err != nil {
+		panic(err.Error())
+	}
 	controller.Run(stopCh, ctx)
 }
@@ -0,0 +1,238 @@
+package posture
+
+import (
+	"altc-agent/altc"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"strings"
+)
+
+const _defaultServiceAccount = "default"
+
+// container holds the fields checked by the rules of a container of any type
+type container struct {
+	name            string
+	ephemeral       bool
+	securityContext *corev1.SecurityContext
+	resources       corev1.ResourceRequirements
+	ports           []corev1.ContainerPort
+}
+
+// podSpec returns the pod spec of a Pod or of a workload's pod template, nil for other objects
+func podSpec(obj interface{}) *corev1.PodSpec {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		return &o.Spec
+	case *corev1.PodTemplate:
+		return &o.Template.Spec
+	case *corev1.ReplicationController:
+		if o.Spec.Template != nil {
+			return &o.Spec.Template.Spec
+		}
+	case *appsv1.Deployment:
+		return &o.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		return &o.Spec.Template.Spec
+	case *appsv1.StatefulSet:
+		return &o.Spec.Template.Spec
+	case *appsv1.ReplicaSet:
+		return &o.Spec.Template.Spec
+	case *batchv1.Job:
+		return &o.Spec.Template.Spec
+	case *batchv1.CronJob:
+		return &o.Spec.JobTemplate.Spec.Template.Spec
+	}
+	return nil
+}
+
+// podRule returns a check of the pod specs of Pods and workloads
+func podRule(check func(spec *corev1.PodSpec) []*altc.Finding) func(obj interface{}) []*altc.Finding {
+	return func(obj interface{}) []*altc.Finding {
+		spec := podSpec(obj)
+		if spec == nil {
+			return nil
+		}
+		return check(spec)
+	}
+}
+
+func containers(spec *corev1.PodSpec) []container {
+	all := make([]container, 0, len(spec.InitContainers)+len(spec.Containers)+len(spec.EphemeralContainers))
+	for _, c := range spec.InitContainers {
+		all = append(all, container{name: c.Name, securityContext: c.SecurityContext, resources: c.Resources, ports: c.Ports})
+	}
+	for _, c := range spec.Containers {
+		all = append(all, container{name: c.Name, securityContext: c.SecurityContext, resources: c.Resources, ports: c.Ports})
+	}
+	for _, c := range spec.EphemeralContainers {
+		all = append(all, container{name: c.Name, ephemeral: true, securityContext: c.SecurityContext, resources: c.Resources, ports: c.Ports})
+	}
+	return all
+}
+
+func finding(containerName string, format string, args ...interface{}) *altc.Finding {
+	return &altc.Finding{Message: fmt.Sprintf(format, args...), Container: containerName}
+}
+
+func checkPrivileged(spec *corev1.PodSpec) []*altc.Finding {
+	var findings []*altc.Finding
+	for _, c := range containers(spec) {
+		if c.securityContext != nil && c.securityContext.Privileged != nil && *c.securityContext.Privileged {
+			findings = append(findings, finding(c.name, "container runs privileged"))
+		}
+	}
+	return findings
+}
+
+func checkHostPath(spec *corev1.PodSpec) []*altc.Finding {
+	var findings []*altc.Finding
+	for _, volume := range spec.Volumes {
+		if volume.HostPath != nil {
+			findings = append(findings, finding("", "volume %s mounts host path %s", volume.Name, volume.HostPath.Path))
+		}
+	}
+	return findings
+}
+
+func checkHostNamespaces(spec *corev1.PodSpec) []*altc.Finding {
+	var namespaces []string
+	if spec.HostNetwork {
+		namespaces = append(namespaces, "network")
+	}
+	if spec.HostPID {
+		namespaces = append(namespaces, "PID")
+	}
+	if spec.HostIPC {
+		namespaces = append(namespaces, "IPC")
+	}
+	if len(namespaces) == 0 {
+		return nil
+	}
+	return []*altc.Finding{finding("", "pod shares the host's %s namespace", strings.Join(namespaces, ", "))}
+}
+
+func checkResourceLimits(spec *corev1.PodSpec) []*altc.Finding {
+	var findings []*altc.Finding
+	for _, c := range containers(spec) {
+		// Ephemeral containers can't set resources
+		if c.ephemeral {
+			continue
+		}
+		var missing []string
+		for _, resource := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			if _, ok := c.resources.Limits[resource]; !ok {
+				missing = append(missing, string(resource))
+			}
+		}
+		if len(missing) > 0 {
+			findings = append(findings, finding(c.name, "container has no %s limit", strings.Join(missing, " or ")))
+		}
+	}
+	return findings
+}
+
+func checkRunAsRoot(spec *corev1.PodSpec) []*altc.Finding {
+	var findings []*altc.Finding
+	for _, c := range containers(spec) {
+		runAsUser, runAsNonRoot := effectiveRunAs(spec, c)
+		switch {
+		case runAsUser != nil && *runAsUser == 0:
+			findings = append(findings, finding(c.name, "container runs as root (runAsUser 0)"))
+		case runAsUser == nil && (runAsNonRoot == nil || !*runAsNonRoot):
+			findings = append(findings, finding(c.name, "container may run as root (neither runAsNonRoot nor a non-root runAsUser is set)"))
+		}
+	}
+	return findings
+}
+
+// effectiveRunAs returns the container's runAsUser and runAsNonRoot, which
+// default to the pod's
+func effectiveRunAs(spec *corev1.PodSpec, c container) (runAsUser *int64, runAsNonRoot *bool) {
+	if spec.SecurityContext != nil {
+		runAsUser, runAsNonRoot = spec.SecurityContext.RunAsUser, spec.SecurityContext.RunAsNonRoot
+	}
+	if c.securityContext != nil {
+		if c.securityContext.RunAsUser != nil {
+			runAsUser = c.securityContext.RunAsUser
+		}
+		if c.securityContext.RunAsNonRoot != nil {
+			runAsNonRoot = c.securityContext.RunAsNonRoot
+		}
+	}
+	return runAsUser, runAsNonRoot
+}
+
+func checkWildcardRole(obj interface{}) []*altc.Finding {
+	var rules []rbacv1.PolicyRule
+	switch o := obj.(type) {
+	case *rbacv1.ClusterRole:
+		rules = o.Rules
+	case *rbacv1.Role:
+		rules = o.Rules
+	default:
+		return nil
+	}
+
+	var findings []*altc.Finding
+	for i, rule := range rules {
+		var wildcards []string
+		if contains(rule.Verbs, rbacv1.VerbAll) {
+			wildcards = append(wildcards, "verbs")
+		}
+		if contains(rule.Resources, rbacv1.ResourceAll) {
+			wildcards = append(wildcards, "resources")
+		}
+		if contains(rule.APIGroups, rbacv1.APIGroupAll) {
+			wildcards = append(wildcards, "API groups")
+		}
+		if contains(rule.NonResourceURLs, rbacv1.NonResourceAll) {
+			wildcards = append(wildcards, "non-resource URLs")
+		}
+		if len(wildcards) > 0 {
+			findings = append(findings, finding("", "rule %d grants all %s", i, strings.Join(wildcards, ", ")))
+		}
+	}
+	return findings
+}
+
+// checkDefaultServiceAccountAutomount
+//
+// Flags default ServiceAccounts that don't disable automounting their
+// token, and Pods using a default ServiceAccount that enable it themselves.
+// Pods that leave it to their ServiceAccount are covered by the
+// ServiceAccount's finding.
+func checkDefaultServiceAccountAutomount(obj interface{}) []*altc.Finding {
+	if serviceAccount, ok := obj.(*corev1.ServiceAccount); ok {
+		automount := serviceAccount.AutomountServiceAccountToken
+		if serviceAccount.Name == _defaultServiceAccount && (automount == nil || *automount) {
+			return []*altc.Finding{finding("", "default service account automounts its token in Pods")}
+		}
+		return nil
+	}
+
+	spec := podSpec(obj)
+	if spec == nil {
+		return nil
+	}
+	serviceAccountName := spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = _defaultServiceAccount
+	}
+	automount := spec.AutomountServiceAccountToken
+	if serviceAccountName == _defaultServiceAccount && automount != nil && *automount {
+		return []*altc.Finding{finding("", "pod automounts the default service account's token")}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
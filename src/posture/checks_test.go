@@ -0,0 +1,247 @@
+package posture
+
+import (
+	"altc-agent/altc"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"testing"
+)
+
+func boolPtr(value bool) *bool {
+	return &value
+}
+
+func int64Ptr(value int64) *int64 {
+	return &value
+}
+
+// testPod returns a Pod with a container passing all of the rules, modified by 'modify'
+func testPod(modify func(spec *corev1.PodSpec)) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "app",
+			SecurityContext: &corev1.PodSecurityContext{
+				RunAsNonRoot:   boolPtr(true),
+				SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+			},
+			Containers: []corev1.Container{{
+				Name: "app",
+				Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("1"),
+					corev1.ResourceMemory: resource.MustParse("1Gi"),
+				}},
+				SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: boolPtr(false),
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+				},
+			}},
+			Volumes: []corev1.Volume{{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}}},
+		},
+	}
+	if modify != nil {
+		modify(&pod.Spec)
+	}
+	return pod
+}
+
+// ruleFindings returns the containers of the findings, "" for the pod, by rule
+func ruleFindings(findings []*altc.Finding) map[string][]string {
+	byRule := make(map[string][]string)
+	for _, finding := range findings {
+		byRule[finding.Rule] = append(byRule[finding.Rule], finding.Container)
+	}
+	for _, containers := range byRule {
+		sort.Strings(containers)
+	}
+	return byRule
+}
+
+func TestDefaultRules(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  interface{}
+		// Containers of the findings by rule, "" for findings of the object
+		want map[string][]string
+	}{
+		{name: "compliant pod", obj: testPod(nil), want: map[string][]string{}},
+		{
+			name: "privileged container",
+			obj: testPod(func(spec *corev1.PodSpec) {
+				spec.Containers[0].SecurityContext.Privileged = boolPtr(true)
+			}),
+			want: map[string][]string{"privileged-container": {"app"}, "pod-security-baseline": {"app"}},
+		},
+		{
+			name: "host path volume",
+			obj: testPod(func(spec *corev1.PodSpec) {
+				spec.Volumes = append(spec.Volumes, corev1.Volume{Name: "host",
+					VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/run"}}})
+			}),
+			want: map[string][]string{"host-path-volume": {""}, "pod-security-baseline": {""}},
+		},
+		{
+			name: "host namespaces",
+			obj: testPod(func(spec *corev1.PodSpec) {
+				spec.HostNetwork = true
+				spec.HostPID = true
+			}),
+			want: map[string][]string{"host-namespaces": {""}, "pod-security-baseline": {""}},
+		},
+		{
+			name: "missing resource limits",
+			obj: testPod(func(spec *corev1.PodSpec) {
+				delete(spec.Containers[0].Resources.Limits, corev1.ResourceMemory)
+				spec.EphemeralContainers = []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+					Name:            "debug",
+					SecurityContext: spec.Containers[0].SecurityContext,
+				}}}
+			}),
+			// Ephemeral containers can't set resources
+			want: map[string][]string{"missing-resource-limits": {"app"}},
+		},
+		{
+			name: "run as root",
+			obj: testPod(func(spec *corev1.PodSpec) {
+				spec.Containers[0].SecurityContext.RunAsUser = int64Ptr(0)
+			}),
+			want: map[string][]string{"run-as-root": {"app"}, "pod-security-restricted": {"app"}},
+		},
+		{
+			name: "may run as root",
+			obj: testPod(func(spec *corev1.PodSpec) {
+				spec.SecurityContext.RunAsNonRoot = nil
+			}),
+			want: map[string][]string{"run-as-root": {"app"}, "pod-security-restricted": {"app"}},
+		},
+		{
+			name: "non-root user",
+			obj: testPod(func(spec *corev1.PodSpec) {
+				spec.SecurityContext.RunAsNonRoot = nil
+				spec.Containers[0].SecurityContext.RunAsUser = int64Ptr(1000)
+				spec.Containers[0].SecurityContext.RunAsNonRoot = boolPtr(true)
+			}),
+			want: map[string][]string{},
+		},
+		{
+			name: "workload template",
+			obj: &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: testPod(func(spec *corev1.PodSpec) {
+				spec.HostIPC = true
+			}).Spec}}},
+			want: map[string][]string{"host-namespaces": {""}, "pod-security-baseline": {""}},
+		},
+		{
+			name: "cronjob template",
+			obj: &batchv1.CronJob{Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{Spec: testPod(func(spec *corev1.PodSpec) {
+					spec.Containers[0].SecurityContext.Privileged = boolPtr(true)
+				}).Spec},
+			}}}},
+			want: map[string][]string{"privileged-container": {"app"}, "pod-security-baseline": {"app"}},
+		},
+		{
+			name: "wildcard cluster role",
+			obj: &rbacv1.ClusterRole{Rules: []rbacv1.PolicyRule{
+				{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+				{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+				{Verbs: []string{"get"}, NonResourceURLs: []string{"*"}},
+			}},
+			want: map[string][]string{"wildcard-role": {"", ""}},
+		},
+		{
+			name: "scoped role",
+			obj:  &rbacv1.Role{Rules: []rbacv1.PolicyRule{{Verbs: []string{"get", "list"}, APIGroups: []string{""}, Resources: []string{"configmaps"}}}},
+			want: map[string][]string{},
+		},
+		{
+			name: "default service account",
+			obj:  &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			want: map[string][]string{"default-service-account-automount": {""}},
+		},
+		{
+			name: "default service account without automount",
+			obj:  &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default"}, AutomountServiceAccountToken: boolPtr(false)},
+			want: map[string][]string{},
+		},
+		{
+			name: "other service account",
+			obj:  &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app"}},
+			want: map[string][]string{},
+		},
+		{
+			name: "pod automounting the default service account",
+			obj: testPod(func(spec *corev1.PodSpec) {
+				spec.ServiceAccountName = ""
+				spec.AutomountServiceAccountToken = boolPtr(true)
+			}),
+			want: map[string][]string{"default-service-account-automount": {""}},
+		},
+		{
+			name: "pod leaving automount to the default service account",
+			obj: testPod(func(spec *corev1.PodSpec) {
+				spec.ServiceAccountName = ""
+			}),
+			want: map[string][]string{},
+		},
+		{name: "other object", obj: &corev1.ConfigMap{}, want: map[string][]string{}},
+		{
+			name: "metadata-only object",
+			obj:  &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			want: map[string][]string{},
+		},
+	}
+
+	evaluator := NewEvaluator(DefaultRules())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ruleFindings(evaluator.Evaluate(test.obj))
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("findings = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEvaluatorSetsRuleAndSeverity(t *testing.T) {
+	rules := DefaultRules()
+	for i := range rules {
+		if rules[i].Id == "privileged-container" {
+			rules[i].Severity = LowSeverity
+		}
+	}
+	findings := NewEvaluator(rules).Evaluate(testPod(func(spec *corev1.PodSpec) {
+		spec.Containers[0].SecurityContext.Privileged = boolPtr(true)
+	}))
+
+	severities := make(map[string]string)
+	for _, finding := range findings {
+		if finding.Message == "" {
+			t.Errorf("finding of %s has no message", finding.Rule)
+		}
+		severities[finding.Rule] = finding.Severity
+	}
+	want := map[string]string{"privileged-container": LowSeverity, "pod-security-baseline": HighSeverity}
+	if fmt.Sprint(severities) != fmt.Sprint(want) {
+		t.Errorf("severities = %v, want %v", severities, want)
+	}
+}
+
+func TestEvaluatorRecoversFailingRule(t *testing.T) {
+	rules := []Rule{
+		{Id: "failing", Severity: HighSeverity, Check: func(interface{}) []*altc.Finding { panic("failed") }},
+		{Id: "passing", Severity: LowSeverity, Check: func(interface{}) []*altc.Finding {
+			return []*altc.Finding{{Message: "finding"}}
+		}},
+	}
+
+	findings := NewEvaluator(rules).Evaluate(&corev1.ConfigMap{})
+	if len(findings) != 1 || findings[0].Rule != "passing" {
+		t.Errorf("findings = %v, want the passing rule's", ruleFindings(findings))
+	}
+}
@@ -0,0 +1,180 @@
+package posture
+
+import (
+	"altc-agent/altc"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// Controls of the Pod Security Standards
+// (https://kubernetes.io/docs/concepts/security/pod-security-standards/)
+var (
+	// Capabilities the baseline level allows containers to add
+	baselineCapabilities = map[corev1.Capability]bool{
+		"AUDIT_WRITE": true, "CHOWN": true, "DAC_OVERRIDE": true, "FOWNER": true, "FSETID": true,
+		"KILL": true, "MKNOD": true, "NET_BIND_SERVICE": true, "SETFCAP": true, "SETGID": true,
+		"SETPCAP": true, "SETUID": true, "SYS_CHROOT": true,
+	}
+	baselineSELinuxTypes = map[string]bool{
+		"": true, "container_t": true, "container_init_t": true, "container_kvm_t": true,
+	}
+	baselineSysctls = map[string]bool{
+		"kernel.shm_rmid_forced": true, "net.ipv4.ip_local_port_range": true,
+		"net.ipv4.ip_unprivileged_port_start": true, "net.ipv4.tcp_syncookies": true,
+		"net.ipv4.ping_group_range": true,
+	}
+)
+
+// checkBaseline reports the violations of the baseline level
+func checkBaseline(spec *corev1.PodSpec) []*altc.Finding {
+	var findings []*altc.Finding
+	violation := func(containerName string, format string, args ...interface{}) {
+		findings = append(findings, finding(containerName, "baseline: "+format, args...))
+	}
+
+	if spec.HostNetwork || spec.HostPID || spec.HostIPC {
+		violation("", "host namespaces are shared")
+	}
+	for _, volume := range spec.Volumes {
+		if volume.HostPath != nil {
+			violation("", "hostPath volume %s", volume.Name)
+		}
+	}
+	if podSecurityContext := spec.SecurityContext; podSecurityContext != nil {
+		if options := podSecurityContext.WindowsOptions; options != nil && options.HostProcess != nil && *options.HostProcess {
+			violation("", "windows host process")
+		}
+		if options := podSecurityContext.SELinuxOptions; options != nil && !baselineSELinux(options) {
+			violation("", "SELinux options %s", options.Type)
+		}
+		if profile := podSecurityContext.SeccompProfile; profile != nil && profile.Type == corev1.SeccompProfileTypeUnconfined {
+			violation("", "seccomp profile Unconfined")
+		}
+		for _, sysctl := range podSecurityContext.Sysctls {
+			if !baselineSysctls[sysctl.Name] {
+				violation("", "unsafe sysctl %s", sysctl.Name)
+			}
+		}
+	}
+
+	for _, c := range containers(spec) {
+		for _, port := range c.ports {
+			if port.HostPort != 0 {
+				violation(c.name, "host port %d", port.HostPort)
+			}
+		}
+
+		sc := c.securityContext
+		if sc == nil {
+			continue
+		}
+		if sc.Privileged != nil && *sc.Privileged {
+			violation(c.name, "privileged")
+		}
+		if sc.WindowsOptions != nil && sc.WindowsOptions.HostProcess != nil && *sc.WindowsOptions.HostProcess {
+			violation(c.name, "windows host process")
+		}
+		if sc.Capabilities != nil {
+			var added []string
+			for _, capability := range sc.Capabilities.Add {
+				if !baselineCapabilities[capability] {
+					added = append(added, string(capability))
+				}
+			}
+			if len(added) > 0 {
+				violation(c.name, "adds capabilities %s", strings.Join(added, ", "))
+			}
+		}
+		if sc.SELinuxOptions != nil && !baselineSELinux(sc.SELinuxOptions) {
+			violation(c.name, "SELinux options %s", sc.SELinuxOptions.Type)
+		}
+		if sc.ProcMount != nil && *sc.ProcMount != corev1.DefaultProcMount {
+			violation(c.name, "proc mount %s", *sc.ProcMount)
+		}
+		if sc.SeccompProfile != nil && sc.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+			violation(c.name, "seccomp profile Unconfined")
+		}
+	}
+	return findings
+}
+
+func baselineSELinux(options *corev1.SELinuxOptions) bool {
+	return baselineSELinuxTypes[options.Type] && options.User == "" && options.Role == ""
+}
+
+// checkRestricted
+//
+// Reports the violations of the controls the restricted level adds to the
+// baseline level; baseline violations are reported by checkBaseline.
+func checkRestricted(spec *corev1.PodSpec) []*altc.Finding {
+	var findings []*altc.Finding
+	violation := func(containerName string, format string, args ...interface{}) {
+		findings = append(findings, finding(containerName, "restricted: "+format, args...))
+	}
+
+	for _, volume := range spec.Volumes {
+		// hostPath volumes are baseline violations
+		if volume.HostPath == nil && !restrictedVolume(volume.VolumeSource) {
+			violation("", "volume %s is not of an allowed type", volume.Name)
+		}
+	}
+
+	var podSeccomp *corev1.SeccompProfile
+	if spec.SecurityContext != nil {
+		podSeccomp = spec.SecurityContext.SeccompProfile
+	}
+
+	for _, c := range containers(spec) {
+		sc := c.securityContext
+		if sc == nil {
+			sc = &corev1.SecurityContext{}
+		}
+
+		if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+			violation(c.name, "allowPrivilegeEscalation is not false")
+		}
+
+		runAsUser, runAsNonRoot := effectiveRunAs(spec, c)
+		if runAsNonRoot == nil || !*runAsNonRoot {
+			violation(c.name, "runAsNonRoot is not true")
+		}
+		if runAsUser != nil && *runAsUser == 0 {
+			violation(c.name, "runAsUser is 0")
+		}
+
+		seccomp := podSeccomp
+		if sc.SeccompProfile != nil {
+			seccomp = sc.SeccompProfile
+		}
+		if seccomp == nil || (seccomp.Type != corev1.SeccompProfileTypeRuntimeDefault && seccomp.Type != corev1.SeccompProfileTypeLocalhost) {
+			violation(c.name, "seccomp profile is not RuntimeDefault or Localhost")
+		}
+
+		dropsAll := false
+		var added []string
+		if sc.Capabilities != nil {
+			for _, capability := range sc.Capabilities.Drop {
+				dropsAll = dropsAll || capability == "ALL"
+			}
+			// Capabilities outside of the baseline's are baseline violations
+			for _, capability := range sc.Capabilities.Add {
+				if capability != "NET_BIND_SERVICE" && baselineCapabilities[capability] {
+					added = append(added, string(capability))
+				}
+			}
+		}
+		if !dropsAll {
+			violation(c.name, "capabilities do not drop ALL")
+		}
+		if len(added) > 0 {
+			violation(c.name, "adds capabilities %s", strings.Join(added, ", "))
+		}
+	}
+	return findings
+}
+
+// restrictedVolume returns whether the restricted level allows the volume's type
+func restrictedVolume(volume corev1.VolumeSource) bool {
+	return volume.ConfigMap != nil || volume.CSI != nil || volume.DownwardAPI != nil || volume.EmptyDir != nil ||
+		volume.Ephemeral != nil || volume.PersistentVolumeClaim != nil || volume.Projected != nil || volume.Secret != nil
+}
@@ -0,0 +1,177 @@
+package posture
+
+import (
+	"altc-agent/altc"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+	"testing"
+)
+
+func TestCheckBaseline(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(spec *corev1.PodSpec)
+		// Messages of the violations, without the level prefix
+		want []string
+	}{
+		{name: "compliant"},
+		{
+			name:   "host namespaces",
+			modify: func(spec *corev1.PodSpec) { spec.HostPID = true },
+			want:   []string{"host namespaces are shared"},
+		},
+		{
+			name: "host port",
+			modify: func(spec *corev1.PodSpec) {
+				spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 80, HostPort: 8080}}
+			},
+			want: []string{"host port 8080"},
+		},
+		{
+			name: "capabilities",
+			modify: func(spec *corev1.PodSpec) {
+				spec.Containers[0].SecurityContext.Capabilities.Add = []corev1.Capability{"CHOWN", "SYS_ADMIN", "NET_ADMIN"}
+			},
+			want: []string{"adds capabilities SYS_ADMIN, NET_ADMIN"},
+		},
+		{
+			name: "SELinux",
+			modify: func(spec *corev1.PodSpec) {
+				spec.SecurityContext.SELinuxOptions = &corev1.SELinuxOptions{Type: "container_t"}
+				spec.Containers[0].SecurityContext.SELinuxOptions = &corev1.SELinuxOptions{Type: "spc_t"}
+			},
+			want: []string{"SELinux options spc_t"},
+		},
+		{
+			name: "proc mount",
+			modify: func(spec *corev1.PodSpec) {
+				procMount := corev1.UnmaskedProcMount
+				spec.Containers[0].SecurityContext.ProcMount = &procMount
+			},
+			want: []string{"proc mount Unmasked"},
+		},
+		{
+			name: "unconfined seccomp",
+			modify: func(spec *corev1.PodSpec) {
+				spec.SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}
+			},
+			want: []string{"seccomp profile Unconfined"},
+		},
+		{
+			name: "sysctls",
+			modify: func(spec *corev1.PodSpec) {
+				spec.SecurityContext.Sysctls = []corev1.Sysctl{{Name: "net.ipv4.tcp_syncookies"}, {Name: "kernel.msgmax"}}
+			},
+			want: []string{"unsafe sysctl kernel.msgmax"},
+		},
+		{
+			name: "windows host process",
+			modify: func(spec *corev1.PodSpec) {
+				spec.SecurityContext.WindowsOptions = &corev1.WindowsSecurityContextOptions{HostProcess: boolPtr(true)}
+			},
+			want: []string{"windows host process"},
+		},
+		{
+			name: "no security context",
+			modify: func(spec *corev1.PodSpec) {
+				spec.SecurityContext = nil
+				spec.Containers[0].SecurityContext = nil
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertViolations(t, "baseline: ", checkBaseline(&testPod(test.modify).Spec), test.want)
+		})
+	}
+}
+
+func TestCheckRestricted(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(spec *corev1.PodSpec)
+		want   []string
+	}{
+		{name: "compliant"},
+		{
+			name: "no security context",
+			modify: func(spec *corev1.PodSpec) {
+				spec.SecurityContext = nil
+				spec.Containers[0].SecurityContext = nil
+			},
+			want: []string{
+				"allowPrivilegeEscalation is not false",
+				"runAsNonRoot is not true",
+				"seccomp profile is not RuntimeDefault or Localhost",
+				"capabilities do not drop ALL",
+			},
+		},
+		{
+			name: "volume types",
+			modify: func(spec *corev1.PodSpec) {
+				spec.Volumes = append(spec.Volumes,
+					corev1.Volume{Name: "nfs", VolumeSource: corev1.VolumeSource{NFS: &corev1.NFSVolumeSource{}}},
+					// A baseline violation
+					corev1.Volume{Name: "host", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{}}})
+			},
+			want: []string{"volume nfs is not of an allowed type"},
+		},
+		{
+			name: "container seccomp overrides the pod's",
+			modify: func(spec *corev1.PodSpec) {
+				spec.Containers[0].SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}
+			},
+			want: []string{"seccomp profile is not RuntimeDefault or Localhost"},
+		},
+		{
+			name: "localhost seccomp",
+			modify: func(spec *corev1.PodSpec) {
+				spec.SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost}
+			},
+		},
+		{
+			name: "root user",
+			modify: func(spec *corev1.PodSpec) {
+				spec.SecurityContext.RunAsUser = int64Ptr(0)
+			},
+			want: []string{"runAsUser is 0"},
+		},
+		{
+			name: "capabilities",
+			modify: func(spec *corev1.PodSpec) {
+				// Only NET_BIND_SERVICE can be added, SYS_ADMIN is a baseline violation
+				spec.Containers[0].SecurityContext.Capabilities.Add = []corev1.Capability{"NET_BIND_SERVICE", "CHOWN", "SYS_ADMIN"}
+			},
+			want: []string{"adds capabilities CHOWN"},
+		},
+		{
+			name: "init container",
+			modify: func(spec *corev1.PodSpec) {
+				spec.InitContainers = []corev1.Container{{Name: "init", SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: boolPtr(true),
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+				}}}
+			},
+			want: []string{"allowPrivilegeEscalation is not false"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertViolations(t, "restricted: ", checkRestricted(&testPod(test.modify).Spec), test.want)
+		})
+	}
+}
+
+func assertViolations(t *testing.T, prefix string, findings []*altc.Finding, want []string) {
+	t.Helper()
+	got := make([]string, 0, len(findings))
+	for _, finding := range findings {
+		if !strings.HasPrefix(finding.Message, prefix) {
+			t.Errorf("message %q does not start with %q", finding.Message, prefix)
+		}
+		got = append(got, strings.TrimPrefix(finding.Message, prefix))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("violations = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package posture
+
+import (
+	"altc-agent/altc"
+	"fmt"
+)
+
+// Severities of findings
+const (
+	LowSeverity    = "low"
+	MediumSeverity = "medium"
+	HighSeverity   = "high"
+)
+
+// Rule
+//
+// A security posture check evaluated against each collected object. Check
+// is a pure function of the object, so a rule can be evaluated against
+// fixture objects; it returns the rule's findings for the object, if any,
+// with only their message (and container) set, the evaluator sets the rule
+// id and severity.
+type Rule struct {
+	Id          string
+	Severity    string
+	Description string
+	Check       func(obj interface{}) []*altc.Finding
+}
+
+// DefaultRules returns the built-in rules
+func DefaultRules() []Rule {
+	return []Rule{
+		{
+			Id:          "privileged-container",
+			Severity:    HighSeverity,
+			Description: "Containers run privileged, with access to the host's devices",
+			Check:       podRule(checkPrivileged),
+		},
+		{
+			Id:          "host-path-volume",
+			Severity:    HighSeverity,
+			Description: "Pods mount directories of the host",
+			Check:       podRule(checkHostPath),
+		},
+		{
+			Id:          "host-namespaces",
+			Severity:    HighSeverity,
+			Description: "Pods share the host's network, PID or IPC namespace",
+			Check:       podRule(checkHostNamespaces),
+		},
+		{
+			Id:          "missing-resource-limits",
+			Severity:    MediumSeverity,
+			Description: "Containers without CPU or memory limits",
+			Check:       podRule(checkResourceLimits),
+		},
+		{
+			Id:          "run-as-root",
+			Severity:    MediumSeverity,
+			Description: "Containers run, or may run, as root",
+			Check:       podRule(checkRunAsRoot),
+		},
+		{
+			Id:          "wildcard-role",
+			Severity:    HighSeverity,
+			Description: "ClusterRoles and Roles granting wildcard verbs, resources or API groups",
+			Check:       checkWildcardRole,
+		},
+		{
+			Id:          "default-service-account-automount",
+			Severity:    LowSeverity,
+			Description: "Default service accounts, or Pods using them, automounting the service account token",
+			Check:       checkDefaultServiceAccountAutomount,
+		},
+		{
+			Id:          "pod-security-baseline",
+			Severity:    HighSeverity,
+			Description: "Pods violating the baseline Pod Security Standard",
+			Check:       podRule(checkBaseline),
+		},
+		{
+			Id:          "pod-security-restricted",
+			Severity:    LowSeverity,
+			Description: "Pods violating the restricted Pod Security Standard (beyond the baseline)",
+			Check:       podRule(checkRestricted),
+		},
+	}
+}
+
+// ValidSeverity returns whether 'severity' is a severity
+func ValidSeverity(severity string) bool {
+	return severity == LowSeverity || severity == MediumSeverity || severity == HighSeverity
+}
+
+// Evaluator evaluates rules against objects
+type Evaluator struct {
+	rules []Rule
+}
+
+func NewEvaluator(rules []Rule) *Evaluator {
+	return &Evaluator{rules: rules}
+}
+
+func (e *Evaluator) Rules() []Rule {
+	return e.rules
+}
+
+// Evaluate returns the findings of the rules for the object, nil if there are none
+func (e *Evaluator) Evaluate(obj interface{}) []*altc.Finding {
+	var findings []*altc.Finding
+	for _, rule := range e.rules {
+		for _, finding := range e.check(rule, obj) {
+			finding.Rule = rule.Id
+			finding.Severity = rule.Severity
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+// check runs a rule's check, so a failing rule doesn't fail the collection
+func (e *Evaluator) check(rule Rule, obj interface{}) (findings []*altc.Finding) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println(fmt.Sprintf("ERROR: posture rule %s failed: %v", rule.Id, r))
+			findings = nil
+		}
+	}()
+	return rule.Check(obj)
+}